@@ -4,31 +4,70 @@ const (
 	TokenBucketAlg = iota
 	CounterAlg
 	LeakyBucketAlg
+	CounterReserveAlg
+	TokenBucketReserveAlg
+	LeakyBucketReserveAlg
+	LeakyBucketCancelAlg
+	SlidingLogAlg
+	SlidingWindowAlg
+	GCRAAlg
+	ConcurrencyAcquireAlg
+	ConcurrencyRenewAlg
+	CounterRefundAlg
+	TokenBucketRefundAlg
+	ConcurrencyReleaseAlg
+	TokenBucketCancelAlg
 )
 
-const counterScript = `
+/*
+overrideScript reads the limit of KEYS[1] from the hash KEYS[2], which is written by Overrides,
+override is nil if KEYS[2] is not given or the key has no limit of its own.
+*/
+const overrideScript = `
+local override = nil
+if KEYS[2] then
+    local value = redis.call("HGET", KEYS[2], KEYS[1])
+    if value then
+        override = cjson.decode(value)
+    end
+end
+`
+
+/*
+return {count, remaining, reset, window, throughput}, reset is the microseconds until the next window,
+the tokens are counted in the key key_prefix:window, throughput is the limit of the key.
+*/
+const counterScript = overrideScript + `
 local key_prefix = KEYS[1]
 -- unit is microseconds
 local unit = tonumber(ARGV[1])
 local throughput = tonumber(ARGV[2])
 local batch_size = tonumber(ARGV[3])
+if override then
+    unit = override.duration_ms * 1000
+    throughput = override.throughput
+end
+-- the number of permits the caller needs at least, all or nothing
+local required = tonumber(ARGV[4])
 local timestamp = redis.call("TIME")
 local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
-local key = key_prefix .. ":" .. math.floor(current_timestamp/unit)
+local window = math.floor(current_timestamp/unit)
+local key = key_prefix .. ":" .. window
+local reset = (window + 1) * unit - current_timestamp
 local n = redis.call("GET", key)
 if n == false then
     n = 0
 else
     n = tonumber(n)
 end
-if n >= throughput then
-    return 0
+if throughput - n < required then
+    return {0, throughput - n, reset, window, throughput}
 end
-local increment = math.min(throughput - n, batch_size)
+local increment = math.min(throughput - n, math.max(batch_size, required))
 redis.replicate_commands();
 redis.call("INCRBY", key, increment)
-redis.call("EXPIRE", key, 3 * unit/1000000)
-return increment
+redis.call("PEXPIRE", key, math.ceil(3 * unit / 1000))
+return {increment, throughput - n - increment, reset, window, throughput}
 `
 
 /*
@@ -37,13 +76,24 @@ return increment
 	key ->
 		token_count -> {token_count}
 		updateTime -> {lastUpdateTime}* 1000000  +  {microsecond}
+
+	The key expires when the bucket is full again.
+
+	return {count, remaining, retry_after, reset, max_capacity}, retry_after and reset are in microseconds,
+	reset is the time until the bucket is full, max_capacity is the limit of the key.
 */
 
-const TokenBucketScript = `
+const TokenBucketScript = overrideScript + `
 local bucket = KEYS[1]
 local throughput_per_sec = tonumber(ARGV[1])
 local batch_size = tonumber(ARGV[2])
 local max_capacity = tonumber(ARGV[3])
+if override then
+    throughput_per_sec = override.throughput / override.duration_ms * 1000
+    max_capacity = override.burst or override.throughput
+end
+-- the number of permits the caller needs at least, all or nothing
+local required = tonumber(ARGV[4])
 
 local count = 0
 local lastUpdateTime = redis.call("HGET", bucket, "updateTime")
@@ -67,22 +117,25 @@ end
 
 n = math.min(n + increment, max_capacity)
 
-if n > batch_size then
-	n = n - batch_size
-	count = batch_size
+local retry_after = 0
+if n >= required then
+	count = math.floor(math.min(n, math.max(batch_size, required)))
+	n = n - count
 else
-	count = n
-	n = 0
+	retry_after = math.ceil((required - n) / throughput_per_sec * 1000000)
 end
 
 redis.replicate_commands();
 
+-- token_count already includes the increment, so updateTime must move forward
+-- every time, otherwise the same period would be refilled twice
 redis.call("HSET", bucket, "token_count", n)
-if increment >= 1 then
-	redis.call("HSET", bucket, "updateTime", current_timestamp)
-end
+redis.call("HSET", bucket, "updateTime", current_timestamp)
 
-return count
+local reset = math.ceil((max_capacity - n) / throughput_per_sec * 1000000)
+-- the bucket is full once it expires, and a missing key is a full bucket
+redis.call("PEXPIRE", bucket, math.max(math.ceil(reset / 1000), 1))
+return {count, math.floor(n), retry_after, reset, max_capacity}
 `
 
 /*
@@ -90,29 +143,518 @@ return count
 
 	    // updateTime
 		key -> {lastUpdateTime}* 1000000  +  {microsecond}
+
+		return {count, wait, throughput, interval}, wait is the microseconds until the next permit leaks out,
+		the key expires after it. throughput and interval are the limit of the key.
 */
-const LeakyBucketScript = `
+const LeakyBucketScript = overrideScript + `
 local bucket = KEYS[1]
 local interval = tonumber(ARGV[1])
+local throughput = tonumber(ARGV[2])
+if override then
+    interval = math.floor(override.duration_ms * 1000 / override.throughput)
+    throughput = override.throughput
+end
+-- the number of permits the caller needs
+local required = tonumber(ARGV[3])
 
 local count = 0
 local lastUpdateTime = redis.call("GET", bucket)
 
 if lastUpdateTime == false then
     lastUpdateTime = 0
+else
+    lastUpdateTime = tonumber(lastUpdateTime)
 end
 
-local current_timestamp = tonumber(redis.call("TIME")[1]) * 1000000 + tonumber(redis.call("TIME")[2])
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
 
-if current_timestamp > tonumber(lastUpdateTime) + interval then
-	count = 1
+if current_timestamp > lastUpdateTime + interval and required <= throughput then
+	count = required
+	-- n permits drain the bucket for n intervals
+	lastUpdateTime = current_timestamp + (required - 1) * interval
 	redis.replicate_commands();
-	redis.call("SET", bucket, current_timestamp)
+	-- the key is useless once the last permit has leaked out, a missing key is an empty bucket
+	redis.call("SET", bucket, lastUpdateTime, "PX", math.ceil((lastUpdateTime + interval - current_timestamp) / 1000))
+end
+
+-- the microseconds until the next permit leaks out
+return {count, lastUpdateTime + interval - current_timestamp, throughput, interval}
+`
+
+/*
+Reserve the permits in the current window or the next one.
+return {delay, window}, delay is in microseconds and -1 means that
+neither of the windows has enough permits left.
+*/
+const counterReserveScript = overrideScript + `
+local key_prefix = KEYS[1]
+-- unit is microseconds
+local unit = tonumber(ARGV[1])
+local throughput = tonumber(ARGV[2])
+if override then
+    unit = override.duration_ms * 1000
+    throughput = override.throughput
+end
+local required = tonumber(ARGV[3])
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+local window = math.floor(current_timestamp/unit)
+for i = 0, 1 do
+    local key = key_prefix .. ":" .. (window + i)
+    local n = redis.call("GET", key)
+    if n == false then
+        n = 0
+    else
+        n = tonumber(n)
+    end
+    if throughput - n >= required then
+        redis.replicate_commands();
+        redis.call("INCRBY", key, required)
+        redis.call("PEXPIRE", key, math.ceil(3 * unit / 1000))
+        local delay = 0
+        if i > 0 then
+            delay = (window + 1) * unit - current_timestamp
+        end
+        return {delay, window + i}
+    end
+end
+return {-1, 0}
+`
+
+/*
+The token count may become negative, the tokens are borrowed from the future.
+lastEvent is the time to act of the latest reservation, like the one of rate.Limiter.
+return {delay, time_to_act}, delay is the microseconds until the tokens are refilled,
+time_to_act is the time when they are, in microseconds.
+delay is -1 if required is greater than max_capacity, the tokens would never be refilled.
+*/
+const TokenBucketReserveScript = overrideScript + `
+local bucket = KEYS[1]
+local throughput_per_sec = tonumber(ARGV[1])
+local max_capacity = tonumber(ARGV[2])
+if override then
+    throughput_per_sec = override.throughput / override.duration_ms * 1000
+    max_capacity = override.burst or override.throughput
+end
+local required = tonumber(ARGV[3])
+if required > max_capacity then
+    return {-1, 0}
+end
+
+local lastUpdateTime = redis.call("HGET", bucket, "updateTime")
+if lastUpdateTime == false then
+    lastUpdateTime = 0
+end
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+local increment = (current_timestamp - tonumber(lastUpdateTime)) / 1000000 * throughput_per_sec
+local n = redis.call("HGET", bucket, "token_count")
+if n == false then
+    n = 0
+else
+    n = tonumber(n)
+end
+
+n = math.min(n + increment, max_capacity) - required
+
+local delay = 0
+if n < 0 then
+    delay = math.ceil(-n / throughput_per_sec * 1000000)
+end
+local time_to_act = current_timestamp + delay
+
+redis.replicate_commands();
+redis.call("HSET", bucket, "token_count", n)
+redis.call("HSET", bucket, "updateTime", current_timestamp)
+redis.call("HSET", bucket, "lastEvent", time_to_act)
+redis.call("PEXPIRE", bucket, math.max(math.ceil((max_capacity - n) / throughput_per_sec * 1000), 1))
+
+return {delay, time_to_act}
+`
+
+/*
+The permits leak out at max(now, lastUpdateTime + interval).
+return {delay, new lastUpdateTime, old lastUpdateTime}, delay is in microseconds,
+and -1 if required is greater than throughput.
+*/
+const LeakyBucketReserveScript = overrideScript + `
+local bucket = KEYS[1]
+local interval = tonumber(ARGV[1])
+local throughput = tonumber(ARGV[2])
+if override then
+    interval = math.floor(override.duration_ms * 1000 / override.throughput)
+    throughput = override.throughput
+end
+local required = tonumber(ARGV[3])
+if required > throughput then
+    return {-1, 0, 0}
+end
+
+local lastUpdateTime = redis.call("GET", bucket)
+if lastUpdateTime == false then
+    lastUpdateTime = 0
+else
+    lastUpdateTime = tonumber(lastUpdateTime)
+end
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+local start = math.max(current_timestamp, lastUpdateTime + interval)
+local updateTime = start + (required - 1) * interval
+
+redis.replicate_commands();
+redis.call("SET", bucket, updateTime, "PX", math.ceil((updateTime + interval - current_timestamp) / 1000))
+
+return {start - current_timestamp, updateTime, lastUpdateTime}
+`
+
+/*
+Restore lastUpdateTime, unless other permits have been taken after the reservation.
+*/
+const LeakyBucketCancelScript = `
+local bucket = KEYS[1]
+local updateTime = tonumber(ARGV[1])
+local lastUpdateTime = ARGV[2]
+
+if tonumber(redis.call("GET", bucket)) == updateTime then
+    redis.replicate_commands();
+    -- the TTL of the reservation is long enough for the old value
+    local ttl = redis.call("PTTL", bucket)
+    if ttl > 0 then
+        redis.call("SET", bucket, lastUpdateTime, "PX", ttl)
+    else
+        redis.call("SET", bucket, lastUpdateTime)
+    end
+    return 1
+end
+return 0
+`
+
+/*
+key Type: Sorted Set
+
+key ->
+
+	member: {seconds}.{microseconds}-{sequence}, score: {timestamp in microseconds}
+
+Every permit is an entry of the sorted set, the entries older than the window are removed.
+return {count, remaining, retry_after, reset}, retry_after and reset are in microseconds,
+reset is the time until all the entries are removed.
+*/
+const SlidingLogScript = `
+local key = KEYS[1]
+-- window is microseconds
+local window = tonumber(ARGV[1])
+local throughput = tonumber(ARGV[2])
+local required = tonumber(ARGV[3])
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+
+redis.replicate_commands();
+redis.call("ZREMRANGEBYSCORE", key, "-inf", current_timestamp - window)
+local n = redis.call("ZCARD", key)
+
+local count = 0
+local retry_after = 0
+if throughput - n >= required then
+    count = required
+    for i = 1, required do
+        -- the sequence keeps the members unique within the same microsecond
+        redis.call("ZADD", key, current_timestamp, timestamp[1] .. "." .. timestamp[2] .. "-" .. (n + i))
+    end
+    n = n + required
+    redis.call("PEXPIRE", key, math.ceil(window / 1000))
 else
-	count = 0
+    -- wait until enough entries are removed
+    local oldest = redis.call("ZRANGE", key, n - throughput + required - 1, n - throughput + required - 1, "WITHSCORES")
+    retry_after = tonumber(oldest[2]) + window - current_timestamp
 end
 
-return count
+local reset = 0
+if n > 0 then
+    local newest = redis.call("ZRANGE", key, -1, -1, "WITHSCORES")
+    reset = tonumber(newest[2]) + window - current_timestamp
+end
+return {count, throughput - n, retry_after, reset}
+`
+
+/*
+key Type: string
+
+{key_prefix}:{window} -> {count}
+
+The number of permits in the sliding window is estimated by
+the previous window weighted by the part of it still in the sliding window, plus the current window.
+return {count, remaining, retry_after, reset}, retry_after and reset are in microseconds,
+reset is the time until the estimated number becomes 0.
+*/
+const SlidingWindowScript = `
+local key_prefix = KEYS[1]
+-- unit is microseconds
+local unit = tonumber(ARGV[1])
+local throughput = tonumber(ARGV[2])
+local required = tonumber(ARGV[3])
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+local window = math.floor(current_timestamp / unit)
+local key = key_prefix .. ":" .. window
+
+local current = tonumber(redis.call("GET", key) or "0")
+local previous = tonumber(redis.call("GET", key_prefix .. ":" .. (window - 1)) or "0")
+-- the part of the current window which has passed
+local elapsed = (current_timestamp - window * unit) / unit
+
+local count = 0
+local retry_after = 0
+if throughput - (previous * (1 - elapsed) + current) >= required then
+    count = required
+    current = current + required
+    redis.replicate_commands();
+    redis.call("INCRBY", key, required)
+    redis.call("PEXPIRE", key, math.ceil(2 * unit / 1000))
+elseif current + required <= throughput then
+    -- wait until the weight of the previous window decreases enough
+    retry_after = math.ceil(((1 - (throughput - current - required) / previous) - elapsed) * unit)
+else
+    -- wait until the current window becomes the previous one and its weight decreases enough
+    local next_elapsed = math.max(1 - (throughput - required) / current, 0)
+    retry_after = math.ceil((window + 1 + next_elapsed) * unit - current_timestamp)
+end
+
+local remaining = math.floor(throughput - (previous * (1 - elapsed) + current))
+local reset = 0
+if current > 0 then
+    reset = (window + 2) * unit - current_timestamp
+elseif previous > 0 then
+    reset = (window + 1) * unit - current_timestamp
+end
+return {count, math.max(remaining, 0), retry_after, reset}
+`
+
+/*
+key Type: string
+
+key -> {theoretical arrival time in microseconds}
+
+Every permit moves the theoretical arrival time (TAT) forward by one interval,
+a request is allowed if the TAT stays within burst intervals from now.
+return {count, remaining, retry_after, reset}, retry_after and reset are in microseconds,
+reset is the time until the whole burst is available again.
+*/
+const GCRAScript = `
+local key = KEYS[1]
+-- interval is microseconds
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local required = tonumber(ARGV[3])
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+
+local tat = tonumber(redis.call("GET", key) or "0")
+tat = math.max(tat, current_timestamp)
+local new_tat = tat + required * interval
+local allow_at = new_tat - burst * interval
+
+local count = 0
+local retry_after = 0
+if allow_at <= current_timestamp then
+    count = required
+    tat = new_tat
+    redis.replicate_commands();
+    -- the key is useless once the TAT is in the past, the bucket is full again
+    redis.call("SET", key, tat, "PX", math.ceil((tat - current_timestamp) / 1000))
+else
+    retry_after = allow_at - current_timestamp
+end
+
+local remaining = math.floor((current_timestamp - (tat - burst * interval)) / interval)
+return {count, math.max(remaining, 0), retry_after, tat - current_timestamp}
+`
+
+/*
+key Type: Sorted Set
+
+key ->
+
+	member: {lease id}, score: {expiration time in microseconds}
+
+The leases which have expired are removed, then a new lease is added if there is a free slot.
+return {count, in_flight, retry_after}, retry_after is the microseconds until the earliest lease expires.
+*/
+const ConcurrencyAcquireScript = `
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+-- ttl is microseconds
+local ttl = tonumber(ARGV[2])
+local lease_id = ARGV[3]
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+
+redis.replicate_commands();
+redis.call("ZREMRANGEBYSCORE", key, "-inf", current_timestamp)
+local n = redis.call("ZCARD", key)
+if n >= limit then
+    local earliest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+    return {0, n, tonumber(earliest[2]) - current_timestamp}
+end
+
+redis.call("ZADD", key, current_timestamp + ttl, lease_id)
+-- the key lives as long as the latest lease
+local latest = redis.call("ZRANGE", key, -1, -1, "WITHSCORES")
+redis.call("PEXPIRE", key, math.ceil((tonumber(latest[2]) - current_timestamp) / 1000))
+return {1, n + 1, 0}
+`
+
+/*
+Extend a lease which has not expired yet.
+return 1 if the lease is extended, otherwise 0.
+*/
+const ConcurrencyRenewScript = `
+local key = KEYS[1]
+-- ttl is microseconds
+local ttl = tonumber(ARGV[1])
+local lease_id = ARGV[2]
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+
+local expiration = redis.call("ZSCORE", key, lease_id)
+if expiration == false or tonumber(expiration) <= current_timestamp then
+    return 0
+end
+
+redis.replicate_commands();
+redis.call("ZADD", key, current_timestamp + ttl, lease_id)
+local latest = redis.call("ZRANGE", key, -1, -1, "WITHSCORES")
+redis.call("PEXPIRE", key, math.ceil((tonumber(latest[2]) - current_timestamp) / 1000))
+return 1
+`
+
+/*
+Give the unused tokens back to the window they were taken from,
+nothing is given back if the window has expired.
+return the number of tokens given back.
+*/
+const CounterRefundScript = `
+local key = KEYS[1]
+local refund = tonumber(ARGV[1])
+local n = redis.call("GET", key)
+if n == false then
+    return 0
+end
+refund = math.min(refund, tonumber(n))
+redis.replicate_commands();
+redis.call("DECRBY", key, refund)
+return refund
+`
+
+/*
+Put the unused tokens back into the bucket, the bucket never exceeds max_capacity.
+return the number of tokens put back.
+*/
+const TokenBucketRefundScript = overrideScript + `
+local bucket = KEYS[1]
+local throughput_per_sec = tonumber(ARGV[1])
+local max_capacity = tonumber(ARGV[2])
+if override then
+    throughput_per_sec = override.throughput / override.duration_ms * 1000
+    max_capacity = override.burst or override.throughput
+end
+local refund = tonumber(ARGV[3])
+
+local lastUpdateTime = redis.call("HGET", bucket, "updateTime")
+-- a missing key is a full bucket
+if lastUpdateTime == false then
+    return 0
+end
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+local increment = (current_timestamp - tonumber(lastUpdateTime)) / 1000000 * throughput_per_sec
+local n = tonumber(redis.call("HGET", bucket, "token_count"))
+n = math.min(n + increment, max_capacity)
+refund = math.min(refund, max_capacity - n)
+n = n + refund
+
+redis.replicate_commands();
+redis.call("HSET", bucket, "token_count", n)
+redis.call("HSET", bucket, "updateTime", current_timestamp)
+redis.call("PEXPIRE", bucket, math.max(math.ceil((max_capacity - n) / throughput_per_sec * 1000), 1))
+
+return math.floor(refund)
+`
+
+/*
+Give back the tokens of a reservation which acts at time_to_act, like CancelAt of rate.Reservation.
+The tokens refilled between time_to_act and lastEvent are used by the later reservations,
+so they are not given back, and nothing is given back once time_to_act has passed.
+return the number of tokens given back.
+*/
+const TokenBucketCancelScript = overrideScript + `
+local bucket = KEYS[1]
+local throughput_per_sec = tonumber(ARGV[1])
+local max_capacity = tonumber(ARGV[2])
+if override then
+    throughput_per_sec = override.throughput / override.duration_ms * 1000
+    max_capacity = override.burst or override.throughput
+end
+local required = tonumber(ARGV[3])
+local time_to_act = tonumber(ARGV[4])
+
+local lastUpdateTime = redis.call("HGET", bucket, "updateTime")
+-- a missing key is a full bucket
+if lastUpdateTime == false then
+    return 0
+end
+
+local timestamp = redis.call("TIME")
+local current_timestamp = tonumber(timestamp[1]) * 1000000 + tonumber(timestamp[2])
+if time_to_act < current_timestamp then
+    return 0
+end
+local last_event = tonumber(redis.call("HGET", bucket, "lastEvent") or time_to_act)
+local restore = required - (last_event - time_to_act) / 1000000 * throughput_per_sec
+if restore <= 0 then
+    return 0
+end
+
+local increment = (current_timestamp - tonumber(lastUpdateTime)) / 1000000 * throughput_per_sec
+local n = tonumber(redis.call("HGET", bucket, "token_count"))
+n = math.min(n + increment, max_capacity)
+restore = math.min(restore, max_capacity - n)
+n = n + restore
+
+redis.replicate_commands();
+redis.call("HSET", bucket, "token_count", n)
+redis.call("HSET", bucket, "updateTime", current_timestamp)
+if time_to_act == last_event then
+    -- the previous reservation becomes the latest one
+    local prev_event = time_to_act - required / throughput_per_sec * 1000000
+    if prev_event >= current_timestamp then
+        redis.call("HSET", bucket, "lastEvent", prev_event)
+    end
+end
+redis.call("PEXPIRE", bucket, math.max(math.ceil((max_capacity - n) / throughput_per_sec * 1000), 1))
+
+return math.floor(restore)
+`
+
+/*
+Remove a lease, so that its slot is free before it expires.
+return 1 if the lease is removed, otherwise 0.
+*/
+const ConcurrencyReleaseScript = `
+local key = KEYS[1]
+local lease_id = ARGV[1]
+redis.replicate_commands();
+return redis.call("ZREM", key, lease_id)
 `
 
 var (
@@ -124,4 +666,17 @@ func init() {
 	AlgMap[CounterAlg] = counterScript
 	AlgMap[TokenBucketAlg] = TokenBucketScript
 	AlgMap[LeakyBucketAlg] = LeakyBucketScript
+	AlgMap[CounterReserveAlg] = counterReserveScript
+	AlgMap[TokenBucketReserveAlg] = TokenBucketReserveScript
+	AlgMap[LeakyBucketReserveAlg] = LeakyBucketReserveScript
+	AlgMap[LeakyBucketCancelAlg] = LeakyBucketCancelScript
+	AlgMap[SlidingLogAlg] = SlidingLogScript
+	AlgMap[SlidingWindowAlg] = SlidingWindowScript
+	AlgMap[GCRAAlg] = GCRAScript
+	AlgMap[ConcurrencyAcquireAlg] = ConcurrencyAcquireScript
+	AlgMap[ConcurrencyRenewAlg] = ConcurrencyRenewScript
+	AlgMap[CounterRefundAlg] = CounterRefundScript
+	AlgMap[TokenBucketRefundAlg] = TokenBucketRefundScript
+	AlgMap[ConcurrencyReleaseAlg] = ConcurrencyReleaseScript
+	AlgMap[TokenBucketCancelAlg] = TokenBucketCancelScript
 }
@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	slog "github.com/vearne/simplelog"
+	"strings"
+)
+
+/*
+Backend runs the algorithm alg, one of the constants such as CounterAlg, for keys with args,
+as the script of alg in AlgMap does. The result is what the script returns,
+an int64 or a []interface{} of int64, the limiters panic on anything else.
+The limiters created with WithBackend of every package call it instead of redis.
+*/
+type Backend interface {
+	Run(ctx context.Context, alg int, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// RedisBackend runs the scripts with go-redis, it is what the limiters do without a Backend.
+type RedisBackend struct {
+	client redis.Cmdable
+	mode   ScriptMode
+}
+
+// NewRedisBackend creates a Backend which calls the scripts of client as mode says.
+func NewRedisBackend(client redis.Cmdable, mode ScriptMode) *RedisBackend {
+	return &RedisBackend{client: client, mode: mode}
+}
+
+func (b *RedisBackend) Run(ctx context.Context, alg int, keys []string, args ...interface{}) (interface{}, error) {
+	return runRedisScript(ctx, b.client, b.mode, ScriptSHA1(alg), alg, keys, args...).Result()
+}
+
+/*
+Scripter is the part of a redis client which runs scripts, the results are converted as Backend says.
+It is easy to implement with the clients other than go-redis, such as rueidis.
+*/
+type Scripter interface {
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// ScripterBackend runs the scripts with a Scripter.
+type ScripterBackend struct {
+	scripter Scripter
+}
+
+/*
+NewScripterBackend creates a Backend which calls the scripts with EVALSHA,
+if redis has lost the script, it is sent again with EVAL, which caches it.
+*/
+func NewScripterBackend(scripter Scripter) *ScripterBackend {
+	return &ScripterBackend{scripter: scripter}
+}
+
+func (b *ScripterBackend) Run(ctx context.Context, alg int, keys []string, args ...interface{}) (interface{}, error) {
+	script, ok := AlgMap[alg]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %v", AlgName(alg))
+	}
+	scriptSHA1 := ScriptSHA1(alg)
+	x, err := b.scripter.EvalSha(ctx, scriptSHA1, keys, args...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		slog.Warn("script %v is lost, load it again", scriptSHA1)
+		return b.scripter.Eval(ctx, script, keys, args...)
+	}
+	return x, err
+}
+
+/*
+PrepareBackend is PrepareScript for the constructors which accept a Backend,
+nothing is loaded if backend is not nil, it runs the scripts as it likes.
+*/
+func PrepareBackend(ctx context.Context, client redis.Cmdable, backend Backend, alg int, d *Degradation,
+	mode ScriptMode) (string, error) {
+	if backend != nil {
+		return ScriptSHA1(alg), nil
+	}
+	return PrepareScript(ctx, client, alg, d, mode)
+}
+
+// BackendProbe is ScriptProbe for the constructors which accept a Backend, nothing is probed if backend is not nil.
+func BackendProbe(client redis.Cmdable, backend Backend, mode ScriptMode, algs ...int) func(ctx context.Context) error {
+	if backend != nil {
+		return nil
+	}
+	return ScriptProbe(client, mode, algs...)
+}
+
+func runRedisScript(ctx context.Context, client redis.Cmdable, mode ScriptMode, scriptSHA1 string, alg int,
+	keys []string, args ...interface{}) *redis.Cmd {
+	switch mode {
+	case FunctionMode:
+		cmd := client.FCall(ctx, FunctionName(alg), keys, args...)
+		if redis.HasErrorPrefix(cmd.Err(), "Function not found") {
+			slog.Warn("function %v is lost, load the library again", FunctionName(alg))
+			err := LoadLibrary(ctx, client)
+			if err != nil {
+				return cmd
+			}
+			return client.FCall(ctx, FunctionName(alg), keys, args...)
+		}
+		return cmd
+	case EvalMode:
+		return client.Eval(ctx, AlgMap[alg], keys, args...)
+	default:
+		cmd := client.EvalSha(ctx, scriptSHA1, keys, args...)
+		if redis.HasErrorPrefix(cmd.Err(), "NOSCRIPT") {
+			// EVAL caches the script again
+			slog.Warn("script %v is lost, load it again", scriptSHA1)
+			return client.Eval(ctx, AlgMap[alg], keys, args...)
+		}
+		return cmd
+	}
+}
@@ -0,0 +1,156 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AdaptiveFetchInterval is how often an adaptive BatchSizer aims to fetch tokens from redis.
+const AdaptiveFetchInterval = 100 * time.Millisecond
+
+// BatchStater is implemented by the limiters which fetch permits from redis in batches.
+type BatchStater interface {
+	Stats() BatchStats
+}
+
+// BatchStats shows how well the permits fetched in batches are used.
+type BatchStats struct {
+	// The number of takes which are allowed, LocalHits of them are served by the local permits.
+	Takes     int64
+	LocalHits int64
+	// The number of fetches from redis and the sum of their sizes.
+	Fetches       int64
+	FetchedTokens int64
+	// The size of the last fetch and the next one.
+	LastFetchSize int
+	BatchSize     int
+}
+
+// HitRatio returns the ratio of the takes which are served by the local permits.
+func (s BatchStats) HitRatio() float64 {
+	if s.Takes == 0 {
+		return 0
+	}
+	return float64(s.LocalHits) / float64(s.Takes)
+}
+
+// AverageFetchSize returns the average number of permits fetched from redis at a time.
+func (s BatchStats) AverageFetchSize() float64 {
+	if s.Fetches == 0 {
+		return 0
+	}
+	return float64(s.FetchedTokens) / float64(s.Fetches)
+}
+
+/*
+BatchSizer decides how many permits are fetched from redis at a time.
+The size is fixed, unless the BatchSizer is adaptive, then it follows the local consumption rate
+so that redis is requested about every AdaptiveFetchInterval,
+and it never takes more than half of the quota remaining in redis, so the other instances are not starved.
+*/
+type BatchSizer struct {
+	mu       sync.Mutex
+	adaptive bool
+	min      int
+	max      int
+	size     int
+
+	// the permits consumed locally per second, a moving average
+	rate      float64
+	consumed  int64
+	lastFetch time.Time
+
+	stats BatchStats
+}
+
+func NewBatchSizer(size int) *BatchSizer {
+	return &BatchSizer{min: size, max: size, size: size}
+}
+
+// NewAdaptiveBatchSizer creates a BatchSizer whose size is between min and max, min is at least 1.
+func NewAdaptiveBatchSizer(min, max int) *BatchSizer {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &BatchSizer{adaptive: true, min: min, max: max, size: min}
+}
+
+// Size returns the number of permits to fetch next time.
+func (b *BatchSizer) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// SetSize fixes the size, the BatchSizer is not adaptive any more.
+func (b *BatchSizer) SetSize(size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.adaptive = false
+	b.min = size
+	b.max = size
+	b.size = size
+}
+
+// Took records n permits are taken, local is true if no fetch is needed.
+func (b *BatchSizer) Took(n int, local bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consumed += int64(n)
+	b.stats.Takes++
+	if local {
+		b.stats.LocalHits++
+	}
+}
+
+// Fetched records count permits are fetched from redis, and remaining ones are left in redis.
+func (b *BatchSizer) Fetched(count int64, remaining int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.Fetches++
+	b.stats.FetchedTokens += count
+	b.stats.LastFetchSize = int(count)
+	if !b.adaptive {
+		return
+	}
+
+	now := time.Now()
+	if !b.lastFetch.IsZero() {
+		elapsed := now.Sub(b.lastFetch).Seconds()
+		if elapsed > 0 {
+			current := float64(b.consumed) / elapsed
+			if b.rate == 0 {
+				b.rate = current
+			} else {
+				b.rate = (b.rate + current) / 2
+			}
+		}
+	}
+	b.lastFetch = now
+	b.consumed = 0
+
+	size := int(math.Ceil(b.rate * AdaptiveFetchInterval.Seconds()))
+	if half := int(remaining / 2); size > half {
+		size = half
+	}
+	if size < b.min {
+		size = b.min
+	}
+	if size > b.max {
+		size = b.max
+	}
+	b.size = size
+}
+
+// Stats returns the statistics since the BatchSizer is created.
+func (b *BatchSizer) Stats() BatchStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats
+	s.BatchSize = b.size
+	return s
+}
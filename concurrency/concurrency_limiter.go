@@ -0,0 +1,304 @@
+package concurrency
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+	slog "github.com/vearne/simplelog"
+	"sync"
+	"time"
+)
+
+/*
+ConcurrencyLimiter limits the number of operations in flight across processes,
+it works like a semaphore whose slots are leases in a sorted set of redis.
+A lease expires after leaseTTL, so the slot of a crashed holder is freed automatically.
+*/
+type ConcurrencyLimiter struct {
+	ratelimit.BaseRateLimiter
+
+	limit    int
+	leaseTTL time.Duration
+}
+
+type Option func(*ConcurrencyLimiter)
+
+func NewConcurrencyLimiter(ctx context.Context, client redis.Cmdable, key string, limit int,
+	leaseTTL time.Duration, opts ...Option) (*ConcurrencyLimiter, error) {
+
+	newLimiter, err := prepare(ctx, client, limit, leaseTTL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newLimiter(key), nil
+}
+
+// KeyedConcurrencyLimiter limits the operations in flight of every key separately.
+type KeyedConcurrencyLimiter struct {
+	keyPrefix  string
+	newLimiter func(key string) *ConcurrencyLimiter
+}
+
+/*
+NewKeyedConcurrencyLimiter creates a limiter which limits every key separately,
+the key in redis is keyPrefix + key.
+The limiters keep no state in memory, so they are not cached.
+*/
+func NewKeyedConcurrencyLimiter(ctx context.Context, client redis.Cmdable, keyPrefix string, limit int,
+	leaseTTL time.Duration, opts ...Option) (*KeyedConcurrencyLimiter, error) {
+
+	newLimiter, err := prepare(ctx, client, limit, leaseTTL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyedConcurrencyLimiter{keyPrefix: keyPrefix, newLimiter: newLimiter}, nil
+}
+
+// Get returns the limiter of key.
+func (k *KeyedConcurrencyLimiter) Get(key string) *ConcurrencyLimiter {
+	return k.newLimiter(k.keyPrefix + key)
+}
+
+func (k *KeyedConcurrencyLimiter) TryAcquire(ctx context.Context, key string) (*Lease, bool, error) {
+	return k.Get(key).TryAcquire(ctx)
+}
+
+func (k *KeyedConcurrencyLimiter) Acquire(ctx context.Context, key string) (*Lease, error) {
+	return k.Get(key).Acquire(ctx)
+}
+
+// check the arguments and load the script once, then limiters of different keys can be created cheaply
+func prepare(ctx context.Context, client redis.Cmdable, limit int,
+	leaseTTL time.Duration, opts ...Option) (func(key string) *ConcurrencyLimiter, error) {
+
+	if limit <= 0 {
+		return nil, errors.New("limit must greater than 0")
+	}
+
+	if leaseTTL < time.Millisecond {
+		return nil, errors.New("leaseTTL is too small")
+	}
+
+	var preset ConcurrencyLimiter
+	for _, opt := range opts {
+		opt(&preset)
+	}
+	scriptSHA1, err := ratelimit.PrepareBackend(ctx, client, preset.Backend, ratelimit.ConcurrencyAcquireAlg, nil,
+		preset.ScriptMode())
+	if err != nil {
+		return nil, err
+	}
+
+	return func(key string) *ConcurrencyLimiter {
+		r := ConcurrencyLimiter{
+			BaseRateLimiter: ratelimit.BaseRateLimiter{RedisClient: client, ScriptSHA1: scriptSHA1, Key: key},
+			limit:           limit,
+			leaseTTL:        leaseTTL,
+		}
+		r.Alg = ratelimit.ConcurrencyAcquireAlg
+		r.Interval = 50 * time.Millisecond
+
+		// Loop through each option
+		for _, opt := range opts {
+			// Call the option giving the instantiated
+			opt(&r)
+		}
+		return &r
+	}, nil
+}
+
+// WithPollInterval sets how often Acquire retries while all the slots are taken, 50ms by default.
+func WithPollInterval(interval time.Duration) Option {
+	return func(r *ConcurrencyLimiter) {
+		r.Interval = interval
+	}
+}
+
+// WithName sets the name of the limiter which is given to the Observer.
+func WithName(name string) Option {
+	return func(r *ConcurrencyLimiter) {
+		r.Name = name
+	}
+}
+
+/*
+WithObserver sets the Observer which is notified of the acquisitions as decisions of 1 permit,
+the requests to redis, the errors and the waits of Acquire.
+*/
+func WithObserver(observer ratelimit.Observer) Option {
+	return func(r *ConcurrencyLimiter) {
+		r.Observer = observer
+	}
+}
+
+// WithPureEval sends the whole script with EVAL every time, for the redis ACLs which block SCRIPT commands.
+func WithPureEval(pureEval bool) Option {
+	return func(r *ConcurrencyLimiter) {
+		r.PureEval = pureEval
+	}
+}
+
+// WithFunctions calls the functions of the library loaded by FUNCTION LOAD REPLACE instead of the scripts,
+// Redis 7 is required.
+func WithFunctions(useFunctions bool) Option {
+	return func(r *ConcurrencyLimiter) {
+		r.UseFunctions = useFunctions
+	}
+}
+
+// WithBackend runs the scripts with backend instead of the redis client, which may be nil then.
+func WithBackend(backend ratelimit.Backend) Option {
+	return func(r *ConcurrencyLimiter) {
+		r.Backend = backend
+	}
+}
+
+/*
+TryAcquire takes a slot if there is a free one, ok is false otherwise.
+The caller must call Release of the lease once the work is done.
+*/
+func (r *ConcurrencyLimiter) TryAcquire(ctx context.Context) (lease *Lease, ok bool, err error) {
+	lease, _, err = r.tryAcquire(ctx)
+	return lease, lease != nil, err
+}
+
+// Acquire waits until a slot is taken or ctx is done.
+func (r *ConcurrencyLimiter) Acquire(ctx context.Context) (lease *Lease, err error) {
+	start := time.Now()
+	defer func() {
+		r.ObserveWait(1, start, err)
+	}()
+	for {
+		var retryAfter time.Duration
+		lease, retryAfter, err = r.tryAcquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if lease != nil {
+			return lease, nil
+		}
+
+		// the earliest lease expires at the latest, but it may be released much earlier
+		waitTime := r.Interval
+		if retryAfter < waitTime {
+			waitTime = retryAfter
+		}
+		slog.Debug("waitTime:%v", waitTime)
+		timer := time.NewTimer(waitTime)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errors.New("context timeout")
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *ConcurrencyLimiter) tryAcquire(ctx context.Context) (lease *Lease, retryAfter time.Duration, err error) {
+	var d ratelimit.Decision
+	defer func() {
+		r.ObserveDecision(1, d, false, err)
+	}()
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	x, err := r.EvalScript(
+		ctx,
+		[]string{r.Key},
+		r.limit,
+		int(r.leaseTTL/time.Microsecond),
+		id,
+	).Result()
+	if err != nil {
+		r.ObserveFetch(0, start, false, err)
+		return nil, 0, err
+	}
+
+	values := x.([]interface{})
+	d = ratelimit.Decision{
+		Allowed:    values[0].(int64) > 0,
+		Remaining:  r.limit - int(values[1].(int64)),
+		Limit:      r.limit,
+		RetryAfter: time.Duration(values[2].(int64)) * time.Microsecond,
+	}
+	r.ObserveFetch(int(values[0].(int64)), start, false, nil)
+	if !d.Allowed {
+		d.Reason = ratelimit.ReasonQuotaExhausted
+		return nil, d.RetryAfter, nil
+	}
+	return &Lease{limiter: r, id: id, expiresAt: time.Now().Add(r.leaseTTL)}, 0, nil
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generate lease id:%w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/*
+Lease is a slot taken from a ConcurrencyLimiter.
+If the work takes longer than the lease TTL, Renew must be called in time,
+otherwise the slot may be given to others.
+*/
+type Lease struct {
+	mu        sync.Mutex
+	limiter   *ConcurrencyLimiter
+	id        string
+	expiresAt time.Time
+	released  bool
+}
+
+// ID returns the member of the lease in the sorted set.
+func (l *Lease) ID() string {
+	return l.id
+}
+
+// ExpiresAt returns the time when the lease expires, as far as the local clock knows.
+func (l *Lease) ExpiresAt() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.expiresAt
+}
+
+// Renew extends the lease by the lease TTL, ok is false if the lease has already expired or been released.
+func (l *Lease) Renew(ctx context.Context) (ok bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return false, nil
+	}
+
+	r := l.limiter
+	x, err := r.RunScript(ctx, ratelimit.ConcurrencyRenewAlg, []string{r.Key},
+		int(r.leaseTTL/time.Microsecond), l.id).Int64()
+	if err != nil {
+		return false, err
+	}
+	if x == 0 {
+		return false, nil
+	}
+	l.expiresAt = time.Now().Add(r.leaseTTL)
+	return true, nil
+}
+
+// Release gives the slot back, it does nothing if the lease has already been released.
+func (l *Lease) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return nil
+	}
+	l.released = true
+	r := l.limiter
+	return r.RunScript(context.Background(), ratelimit.ConcurrencyReleaseAlg, []string{r.Key}, l.id).Err()
+}
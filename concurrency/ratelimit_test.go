@@ -0,0 +1,206 @@
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	key        = "key:concurrency"
+	hashVal    = "25f7db39dbc8d1045fd3f99ce8b8b1ebc7c6d582"
+	renewVal   = "10a81a7bfd8513a527e668b6aee437fe1a2074ee"
+	releaseVal = "cfbf6a7e64f5b78c217624e7891373b60b300de6"
+	// the lease id is random
+	anyID = "*"
+)
+
+func MyMatch(expected, actual []interface{}) error {
+	if len(expected) == len(actual) && len(expected) > 0 && expected[len(expected)-1] == anyID {
+		expected = expected[:len(expected)-1]
+		actual = actual[:len(actual)-1]
+	}
+	expectedStr := fmt.Sprintf("%v", expected)
+	actualStr := fmt.Sprintf("%v", actual)
+	if expectedStr == actualStr {
+		return nil
+	}
+	log.Printf("expectedStr:%v, actualStr:%v", expectedStr, actualStr)
+	return fmt.Errorf("not equal, expectedStr:%s, actualStr:%s", expectedStr, actualStr)
+}
+
+func TestTryAcquire(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{false})
+	mock.ExpectScriptLoad(ratelimit.AlgMap[ratelimit.ConcurrencyAcquireAlg]).SetVal(hashVal)
+	mock.ExpectEvalSha(hashVal, []string{key}, 2, 10000000, anyID).
+		SetVal([]interface{}{int64(1), int64(2), int64(0)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 2, 10000000, anyID).
+		SetVal([]interface{}{int64(0), int64(2), int64(3000000)})
+
+	limiter, err := NewConcurrencyLimiter(context.Background(), db, key, 2, 10*time.Second)
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	lease, ok, err := limiter.TryAcquire(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Len(t, lease.ID(), 32)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), lease.ExpiresAt(), time.Second)
+
+	lease, ok, err = limiter.TryAcquire(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, lease)
+}
+
+func TestRelease(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 2, 10000000, anyID).
+		SetVal([]interface{}{int64(1), int64(1), int64(0)})
+	mock.ExpectEvalSha(renewVal, []string{key}, 10000000, anyID).SetVal(int64(1))
+	mock.ExpectEvalSha(releaseVal, []string{key}, anyID).SetVal(int64(1))
+
+	limiter, err := NewConcurrencyLimiter(context.Background(), db, key, 2, 10*time.Second)
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	lease, ok, err := limiter.TryAcquire(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = lease.Renew(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Nil(t, lease.Release())
+	// released already, redis is not called again
+	assert.Nil(t, lease.Release())
+	ok, err = lease.Renew(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestContextTimeOut(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	for i := 0; i < 1000; i++ {
+		mock.ExpectEvalSha(hashVal, []string{key}, 2, 10000000, anyID).
+			SetVal([]interface{}{int64(0), int64(2), int64(5000000)})
+	}
+
+	limiter, err := NewConcurrencyLimiter(context.Background(), db, key, 2, 10*time.Second)
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = limiter.Acquire(waitCtx)
+	assert.Contains(t, err.Error(), "timeout")
+}
+
+func TestMemoryBackend(t *testing.T) {
+	limiter, err := NewConcurrencyLimiter(context.Background(), nil, key, 1, 10*time.Second,
+		WithBackend(ratelimit.NewMemoryBackend()))
+	assert.Nil(t, err)
+
+	lease, ok, err := limiter.TryAcquire(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, ok, err = limiter.TryAcquire(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = lease.Renew(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, lease.Release())
+	_, ok, err = limiter.TryAcquire(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+// recorder keeps the events it is notified of
+type recorder struct {
+	ratelimit.NopObserver
+	mu        sync.Mutex
+	infos     []ratelimit.ObserverInfo
+	decisions []ratelimit.DecisionEvent
+	fetches   []ratelimit.FetchEvent
+	waits     []ratelimit.WaitEvent
+}
+
+func (o *recorder) OnDecision(info ratelimit.ObserverInfo, e ratelimit.DecisionEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.infos = append(o.infos, info)
+	o.decisions = append(o.decisions, e)
+}
+
+func (o *recorder) OnFetch(info ratelimit.ObserverInfo, e ratelimit.FetchEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fetches = append(o.fetches, e)
+}
+
+func (o *recorder) OnWait(info ratelimit.ObserverInfo, e ratelimit.WaitEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.waits = append(o.waits, e)
+}
+
+func TestObserver(t *testing.T) {
+	o := &recorder{}
+	limiter, err := NewConcurrencyLimiter(context.Background(), nil, key, 1, 10*time.Second,
+		WithBackend(ratelimit.NewMemoryBackend()), WithName("jobs"), WithObserver(o))
+	assert.Nil(t, err)
+
+	lease, err := limiter.Acquire(context.Background())
+	assert.Nil(t, err)
+	_, ok, err := limiter.TryAcquire(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, lease.Release())
+
+	assert.Equal(t, "jobs", o.infos[0].Name)
+	assert.Equal(t, key, o.infos[0].Key)
+	if assert.Len(t, o.decisions, 2) {
+		assert.True(t, o.decisions[0].Decision.Allowed)
+		assert.Equal(t, 0, o.decisions[0].Decision.Remaining)
+		assert.Equal(t, 1, o.decisions[0].Decision.Limit)
+		assert.False(t, o.decisions[1].Decision.Allowed)
+		assert.Equal(t, ratelimit.ReasonQuotaExhausted, o.decisions[1].Decision.Reason)
+		assert.True(t, o.decisions[1].Decision.RetryAfter > 9*time.Second)
+	}
+	if assert.Len(t, o.fetches, 2) {
+		assert.Equal(t, 1, o.fetches[0].Count)
+		assert.Equal(t, 0, o.fetches[1].Count)
+	}
+	if assert.Len(t, o.waits, 1) {
+		assert.Nil(t, o.waits[0].Err)
+	}
+}
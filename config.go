@@ -0,0 +1,218 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Config describes a limiter in a form which can be loaded from JSON or YAML, see New.
+The fields which don't apply to the algorithm must be left zero.
+*/
+type Config struct {
+	// Algorithm is one of "counter", "token_bucket", "leaky_bucket" and "time_window".
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+	// Key is the key in redis, time_window doesn't use redis.
+	Key string `json:"key" yaml:"key"`
+	// Rate is the number of permits in a period, such as "200/s", "5000/1h" and "10/100ms", see ParseRate.
+	Rate string `json:"rate" yaml:"rate"`
+	// Burst is the capacity of the token bucket, the count of Rate by default.
+	Burst int `json:"burst" yaml:"burst"`
+	// Batch is the number of permits the counter and the token bucket fetch from redis at a time, 1 by default.
+	Batch int `json:"batch" yaml:"batch"`
+	// Buckets is the number of buckets of the time window, 10 by default.
+	Buckets int `json:"buckets" yaml:"buckets"`
+	// Name tells the limiter apart in the Observer.
+	Name string `json:"name" yaml:"name"`
+	// Local creates the in-memory limiter of the algorithm, the client, Key and Batch are not used.
+	Local bool `json:"local" yaml:"local"`
+}
+
+// ConfigError is returned by New when a field of Config is invalid, Field is the name of it in JSON and YAML.
+type ConfigError struct {
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// NewConfigError creates a ConfigError of field with a message.
+func NewConfigError(field string, format string, args ...interface{}) *ConfigError {
+	return &ConfigError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// Rate is Count permits every Per.
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%v", r.Count, r.Per)
+}
+
+var periodUnits = map[string]time.Duration{
+	"ms":     time.Millisecond,
+	"s":      time.Second,
+	"sec":    time.Second,
+	"second": time.Second,
+	"m":      time.Minute,
+	"min":    time.Minute,
+	"minute": time.Minute,
+	"h":      time.Hour,
+	"hour":   time.Hour,
+	"d":      24 * time.Hour,
+	"day":    24 * time.Hour,
+}
+
+/*
+ParseRate parses a rate in the form count/period, the period is a unit with an optional number before it,
+such as "200/s", "5000/1h", "10/100ms" and "100/minute".
+The units are ms, s, m, h and d, or sec, second, min, minute, hour and day.
+*/
+func ParseRate(s string) (Rate, error) {
+	count, period, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("%q is not in the form count/period, such as 200/s", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("the count of %q must be a positive integer", s)
+	}
+	per, err := parsePeriod(strings.TrimSpace(period))
+	if err != nil {
+		return Rate{}, fmt.Errorf("the period of %q is invalid, %w", s, err)
+	}
+	return Rate{Count: n, Per: per}, nil
+}
+
+func parsePeriod(s string) (time.Duration, error) {
+	i := strings.IndexFunc(s, func(c rune) bool {
+		return (c < '0' || c > '9') && c != '.'
+	})
+	if i < 0 {
+		return 0, errors.New("the unit is missing")
+	}
+	unit, ok := periodUnits[strings.ToLower(s[i:])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", s[i:])
+	}
+	if i == 0 {
+		return unit, nil
+	}
+	f, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("%q must be a positive number", s[:i])
+	}
+	return time.Duration(f * float64(unit)), nil
+}
+
+/*
+Factory creates a limiter of cfg, rate is parsed from cfg.Rate already.
+The packages of the algorithms register their factories with Register when they are imported.
+*/
+type Factory func(ctx context.Context, client redis.Cmdable, cfg Config, rate Rate) (Limiter, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// the packages of the algorithms which can be created by New, this package can't import them
+var algorithmPackages = map[string]string{
+	"counter":      "github.com/vearne/ratelimit/counter",
+	"token_bucket": "github.com/vearne/ratelimit/tokenbucket",
+	"leaky_bucket": "github.com/vearne/ratelimit/leakybucket",
+	"time_window":  "github.com/vearne/ratelimit/timewindow",
+}
+
+// the names are case insensitive, and "token-bucket", "tokenbucket" and "token_bucket" are the same
+func normalizeAlgorithm(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer("_", "", "-", "", " ", "").Replace(name)
+}
+
+// Register makes the algorithm available to New, it panics if the algorithm is registered twice.
+func Register(algorithm string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	name := normalizeAlgorithm(algorithm)
+	if _, ok := factories[name]; ok {
+		panic("ratelimit: Register called twice for algorithm " + algorithm)
+	}
+	factories[name] = factory
+}
+
+// Algorithms returns the names of the registered algorithms.
+func Algorithms() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+New creates a limiter of cfg with the algorithm registered by its package,
+so the package must be imported, blank import it if it isn't used otherwise:
+
+	import _ "github.com/vearne/ratelimit/counter"
+
+The invalid fields are reported by ConfigError, the errors of redis are returned as they are.
+*/
+func New(ctx context.Context, client redis.Cmdable, cfg Config) (Limiter, error) {
+	if strings.TrimSpace(cfg.Algorithm) == "" {
+		return nil, NewConfigError("algorithm", "it is required")
+	}
+	factoriesMu.RLock()
+	factory, ok := factories[normalizeAlgorithm(cfg.Algorithm)]
+	factoriesMu.RUnlock()
+	if !ok {
+		for name, pkg := range algorithmPackages {
+			if normalizeAlgorithm(name) == normalizeAlgorithm(cfg.Algorithm) {
+				return nil, NewConfigError("algorithm", "%q is not registered, import %s", cfg.Algorithm, pkg)
+			}
+		}
+		return nil, NewConfigError("algorithm", "unknown algorithm %q", cfg.Algorithm)
+	}
+
+	if strings.TrimSpace(cfg.Rate) == "" {
+		return nil, NewConfigError("rate", "it is required")
+	}
+	rate, err := ParseRate(cfg.Rate)
+	if err != nil {
+		return nil, &ConfigError{Field: "rate", Err: err}
+	}
+	if rate.Per < time.Millisecond {
+		return nil, NewConfigError("rate", "the period of %q is less than 1ms", cfg.Rate)
+	}
+	if rate.Per/time.Duration(rate.Count) < time.Microsecond {
+		return nil, NewConfigError("rate", "the count of %q is too large for the period", cfg.Rate)
+	}
+	if cfg.Burst < 0 {
+		return nil, NewConfigError("burst", "it can't be negative")
+	}
+	if cfg.Batch < 0 {
+		return nil, NewConfigError("batch", "it can't be negative")
+	}
+	if cfg.Buckets < 0 {
+		return nil, NewConfigError("buckets", "it can't be negative")
+	}
+	return factory(ctx, client, cfg, rate)
+}
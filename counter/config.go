@@ -0,0 +1,36 @@
+package counter
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+)
+
+func init() {
+	ratelimit.Register("counter", newFromConfig)
+}
+
+// newFromConfig creates the limiter of ratelimit.New, the counter limits Rate.Count permits in every Rate.Per.
+func newFromConfig(ctx context.Context, client redis.Cmdable, cfg ratelimit.Config,
+	rate ratelimit.Rate) (ratelimit.Limiter, error) {
+	if cfg.Burst != 0 {
+		return nil, ratelimit.NewConfigError("burst", "it is not supported by counter")
+	}
+	if cfg.Buckets != 0 {
+		return nil, ratelimit.NewConfigError("buckets", "it is not supported by counter")
+	}
+	if cfg.Local {
+		return NewLocal(rate.Per, rate.Count, WithName(cfg.Name))
+	}
+	if cfg.Key == "" {
+		return nil, ratelimit.NewConfigError("key", "it is required by counter")
+	}
+	batch := cfg.Batch
+	if batch == 0 {
+		batch = 1
+	}
+	if batch > rate.Count {
+		return nil, ratelimit.NewConfigError("batch", "%d is greater than the count of the rate", batch)
+	}
+	return NewCounterRateLimiter(ctx, client, cfg.Key, rate.Per, rate.Count, batch, WithName(cfg.Name))
+}
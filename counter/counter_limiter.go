@@ -2,7 +2,6 @@ package counter
 
 import (
 	"context"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
@@ -10,6 +9,7 @@ import (
 	slog "github.com/vearne/simplelog"
 	"golang.org/x/sync/singleflight"
 	"golang.org/x/time/rate"
+	"strconv"
 	"time"
 )
 
@@ -17,16 +17,31 @@ type CounterLimiter struct {
 	ratelimit.BaseRateLimiter
 	duration   time.Duration
 	throughput int
-	batchSize  int
+	batch      *ratelimit.BatchSizer
 	N          int64
 	g          singleflight.Group
 
+	// the state of redis, updated every time tokens are fetched
+	remaining int64
+	resetAt   time.Time
+	// the limit of the key in redis, which Overrides may change, 0 until it is known
+	limit int64
+	// the window which the local tokens are taken from, they expire at the end of it
+	window   int64
+	expireAt time.Time
+
 	/*
 		If the traffic is too large, the limiter will request Redis frequently.
 		To avoid this situation, the frequency of accessing Redis will be limited.
 	*/
-	AntiDDoS        bool
-	antiDDoSLimiter *rate.Limiter
+	AntiDDoS           bool
+	antiDDoSLimiter    *rate.Limiter
+	antiDDoSMultiplier float64
+	antiDDoSBurst      int
+	// the anti-DDoS limiter is created by the limiter rather than WithAntiDDoSLimiter, SetLimit changes it
+	ownAntiDDoS bool
+
+	degradation *ratelimit.Degradation
 }
 
 type Option func(*CounterLimiter)
@@ -35,57 +50,103 @@ func NewCounterRateLimiter(ctx context.Context, client redis.Cmdable, key string
 	throughput int,
 	batchSize int, opts ...Option) (ratelimit.Limiter, error) {
 
-	_, err := client.Ping(ctx).Result()
+	newLimiter, err := prepare(ctx, client, duration, throughput, batchSize, opts...)
 	if err != nil {
 		return nil, err
 	}
+	return newLimiter(key), nil
+}
 
-	if duration < time.Millisecond {
-		return nil, errors.New("duration is too small")
-	}
+/*
+NewKeyedCounterRateLimiter creates a limiter which limits every key separately,
+the key in redis is keyPrefix + key, and at most maxKeys limiters are kept in memory.
+*/
+func NewKeyedCounterRateLimiter(ctx context.Context, client redis.Cmdable, keyPrefix string,
+	duration time.Duration, throughput int, batchSize int,
+	maxKeys int, opts ...Option) (*ratelimit.KeyedLimiter, error) {
 
-	if throughput <= 0 {
-		return nil, errors.New("throughput must greater than 0")
+	if maxKeys <= 0 {
+		return nil, errors.New("maxKeys must greater than 0")
 	}
 
-	if batchSize <= 0 {
-		return nil, errors.New("batchSize must greater than 0")
+	newLimiter, err := prepare(ctx, client, duration, throughput, batchSize, opts...)
+	if err != nil {
+		return nil, err
 	}
+	return ratelimit.NewKeyedLimiter(maxKeys, func(key string) ratelimit.Limiter {
+		return newLimiter(keyPrefix + key)
+	})
+}
 
-	script := ratelimit.AlgMap[ratelimit.CounterAlg]
-	scriptSHA1 := fmt.Sprintf("%x", sha1.Sum([]byte(script)))
+// check the arguments and load the script once, then limiters of different keys can be created cheaply
+func prepare(ctx context.Context, client redis.Cmdable, duration time.Duration,
+	throughput int,
+	batchSize int, opts ...Option) (func(key string) *CounterLimiter, error) {
 
-	r := CounterLimiter{
-		BaseRateLimiter: ratelimit.BaseRateLimiter{RedisClient: client, ScriptSHA1: scriptSHA1, Key: key},
-		duration:        duration,
-		throughput:      throughput,
-		batchSize:       batchSize,
-		N:               0,
-		AntiDDoS:        true,
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return nil, err
 	}
-	r.Interval = duration / time.Duration(throughput)
 
-	// Loop through each option
-	for _, opt := range opts {
-		// Call the option giving the instantiated
-		opt(&r)
+	if batchSize <= 0 {
+		return nil, errors.New("batchSize must greater than 0")
 	}
 
-	values, err := r.RedisClient.ScriptExists(ctx, r.ScriptSHA1).Result()
+	degradation, mode, backend := presetOf(opts)
+	scriptSHA1, err := ratelimit.PrepareBackend(ctx, client, backend, ratelimit.CounterAlg, degradation, mode)
 	if err != nil {
 		return nil, err
 	}
-	if !values[0] {
-		_, err = r.RedisClient.ScriptLoad(ctx, script).Result()
-		if err != nil {
-			return nil, err
+
+	return func(key string) *CounterLimiter {
+		r := CounterLimiter{
+			BaseRateLimiter: ratelimit.BaseRateLimiter{RedisClient: client, ScriptSHA1: scriptSHA1, Key: key},
+			duration:        duration,
+			throughput:      throughput,
+			batch:           ratelimit.NewBatchSizer(batchSize),
+			N:               0,
+			AntiDDoS:        true,
 		}
-	}
-	// 2x throughput
-	throughputPerSec := int(float64(throughput) / float64(duration/time.Second))
-	r.antiDDoSLimiter = rate.NewLimiter(rate.Limit(throughputPerSec*2), throughputPerSec*2)
+		r.Alg = ratelimit.CounterAlg
+		r.Interval = duration / time.Duration(throughput)
 
-	return &r, nil
+		// Loop through each option
+		for _, opt := range opts {
+			// Call the option giving the instantiated
+			opt(&r)
+		}
+
+		// 2x throughput by default
+		throughputPerSec := ratelimit.PerSecond(throughput, duration)
+		if r.AntiDDoS && r.antiDDoSLimiter == nil {
+			r.antiDDoSLimiter = ratelimit.NewAntiDDoSLimiter(throughputPerSec, throughput,
+				r.antiDDoSMultiplier, r.antiDDoSBurst)
+			r.ownAntiDDoS = true
+		}
+
+		if degradation != nil {
+			probe := ratelimit.BackendProbe(client, backend, mode, ratelimit.CounterAlg)
+			r.Fallback = ratelimit.NewFallback(*degradation, throughputPerSec,
+				throughput, probe)
+		}
+		return &r
+	}, nil
+}
+
+// the options which are needed before the limiters are created, the keys share the circuit breaker
+func presetOf(opts []Option) (*ratelimit.Degradation, ratelimit.ScriptMode, ratelimit.Backend) {
+	var r CounterLimiter
+	for _, opt := range opts {
+		opt(&r)
+	}
+	if r.degradation == nil {
+		return nil, r.ScriptMode(), r.Backend
+	}
+	d := *r.degradation
+	if d.Breaker == nil {
+		d.Breaker = ratelimit.NewCircuitBreaker(ratelimit.DefaultFailureThreshold, ratelimit.DefaultCooldown)
+	}
+	return &d, r.ScriptMode(), r.Backend
 }
 
 // just for test
@@ -95,35 +156,155 @@ func WithAntiDDos(antiDDoS bool) Option {
 	}
 }
 
-func (r *CounterLimiter) tryTakeFromLocal() bool {
+// WithAntiDDoSMultiplier sets how many times the throughput the local anti-DDoS limiter allows, 2 by default.
+func WithAntiDDoSMultiplier(multiplier float64) Option {
+	return func(r *CounterLimiter) {
+		r.antiDDoSMultiplier = multiplier
+	}
+}
+
+// WithAntiDDoSBurst sets how many requests the local anti-DDoS limiter allows at once.
+func WithAntiDDoSBurst(burst int) Option {
+	return func(r *CounterLimiter) {
+		r.antiDDoSBurst = burst
+	}
+}
+
+// WithAntiDDoSLimiter replaces the local anti-DDoS limiter, it is shared by all the keys of a keyed limiter.
+func WithAntiDDoSLimiter(limiter *rate.Limiter) Option {
+	return func(r *CounterLimiter) {
+		r.AntiDDoS = true
+		r.antiDDoSLimiter = limiter
+	}
+}
+
+/*
+WithAdaptiveBatch changes the number of tokens fetched from redis at a time between min and max,
+according to the local consumption rate and the tokens remaining in redis, batchSize is ignored.
+*/
+func WithAdaptiveBatch(min, max int) Option {
+	return func(r *CounterLimiter) {
+		r.batch = ratelimit.NewAdaptiveBatchSizer(min, max)
+	}
+}
+
+// WithDegradation decides what to do when redis is unavailable, the errors are returned by default.
+func WithDegradation(d ratelimit.Degradation) Option {
+	return func(r *CounterLimiter) {
+		r.degradation = &d
+	}
+}
+
+// WithName sets the name of the limiter which is given to the Observer.
+func WithName(name string) Option {
+	return func(r *CounterLimiter) {
+		r.Name = name
+	}
+}
+
+// WithObserver sets the Observer which is notified of the decisions, the requests to redis, the errors and the waits.
+func WithObserver(observer ratelimit.Observer) Option {
+	return func(r *CounterLimiter) {
+		r.Observer = observer
+	}
+}
+
+// WithTracer traces Take, Wait and the scripts with tracer, such as the one of the module ratelimit/otel.
+func WithTracer(tracer ratelimit.Tracer) Option {
+	return func(r *CounterLimiter) {
+		r.Tracer = tracer
+	}
+}
+
+/*
+WithOverrides makes the scripts read the limit of the key from the hash hashKey of ratelimit.Overrides,
+the limit given to the constructor is used if the key has none.
+n is checked against the limit of the key, which Decision.Limit reports,
+but the local checks, such as the anti-DDoS limiter, still use the limit given to the constructor.
+*/
+func WithOverrides(hashKey string) Option {
+	return func(r *CounterLimiter) {
+		r.OverridesKey = hashKey
+	}
+}
+
+// WithPureEval sends the whole script with EVAL every time, for the redis ACLs which block SCRIPT commands.
+func WithPureEval(pureEval bool) Option {
+	return func(r *CounterLimiter) {
+		r.PureEval = pureEval
+	}
+}
+
+// WithFunctions calls the functions of the library loaded by FUNCTION LOAD REPLACE instead of the scripts,
+// Redis 7 is required.
+func WithFunctions(useFunctions bool) Option {
+	return func(r *CounterLimiter) {
+		r.UseFunctions = useFunctions
+	}
+}
+
+// WithBackend runs the scripts with backend instead of the redis client, which may be nil then.
+func WithBackend(backend ratelimit.Backend) Option {
+	return func(r *CounterLimiter) {
+		r.Backend = backend
+	}
+}
+
+// flightKey is the key of the fetches of n tokens, a fetch only covers the callers which take as many tokens
+func (r *CounterLimiter) flightKey(n int) string {
+	return r.Key + ":" + strconv.Itoa(n)
+}
+
+func (r *CounterLimiter) tryTakeFromLocal(n int) bool {
 	r.Lock()
 	defer r.Unlock()
-	if r.N > 0 {
-		r.N = r.N - 1
+	r.dropExpired(time.Now())
+	if r.N >= int64(n) {
+		r.N = r.N - int64(n)
 		return true
 	}
 	return false
 }
 
+// the local tokens can't be used once their window is over, they are counted in it already
+func (r *CounterLimiter) dropExpired(now time.Time) {
+	if r.N > 0 && !now.Before(r.expireAt) {
+		slog.Debug("drop %v expired tokens", r.N)
+		r.N = 0
+	}
+}
+
 // wait until take a token or timeout
 func (r *CounterLimiter) Wait(ctx context.Context) (err error) {
-	ok, err := r.Take(ctx)
+	return r.WaitN(ctx, 1)
+}
+
+// wait until take n tokens at once or timeout
+func (r *CounterLimiter) WaitN(ctx context.Context, n int) (err error) {
+	start := time.Now()
+	ctx, span := r.StartSpan(ctx, "ratelimit.Wait", ratelimit.AttrN.Int(n))
+	defer func() {
+		r.ObserveWait(n, start, err)
+		ratelimit.EndSpan(span, ratelimit.Decision{Allowed: err == nil}, err)
+	}()
+	ok, err := r.TakeN(ctx, n)
 	slog.Debug("r.Take")
 	if err != nil {
 		return err
 	}
+	r.AddPollEvent(ctx, ok)
 	if ok {
 		return nil
 	}
 
 	deadline, ok := ctx.Deadline()
-	minWaitTime := r.Interval
+	minWaitTime := r.WaitInterval()
 
 	slog.Debug("minWaitTime:%v", minWaitTime)
 	if ok {
 		if deadline.Before(time.Now().Add(minWaitTime)) {
 			slog.Debug("can't get token before %v", deadline)
-			return fmt.Errorf("can't get token before %v", deadline)
+			return fmt.Errorf("%w %v", ratelimit.ErrDeadline, deadline)
 		}
 	}
 
@@ -134,10 +315,11 @@ func (r *CounterLimiter) Wait(ctx context.Context) (err error) {
 		case <-ctx.Done():
 			return errors.New("context timeout")
 		case <-timer.C:
-			ok, err := r.Take(ctx)
+			ok, err := r.TakeN(ctx, n)
 			if err != nil {
 				return err
 			}
+			r.AddPollEvent(ctx, ok)
 			if ok {
 				return nil
 			}
@@ -146,39 +328,276 @@ func (r *CounterLimiter) Wait(ctx context.Context) (err error) {
 }
 
 func (r *CounterLimiter) Take(ctx context.Context) (bool, error) {
+	return r.TakeN(ctx, 1)
+}
+
+/*
+TakeN takes n tokens at once, either all of them or none.
+If n is greater than batchSize, the missing part is fetched from redis in one request.
+n can't be greater than throughput, otherwise ratelimit.ErrExceedsLimit is returned.
+*/
+func (r *CounterLimiter) TakeN(ctx context.Context, n int) (bool, error) {
+	d, err := r.TakeDecision(ctx, n)
+	return d.Allowed, err
+}
+
+// TakeDecision works like TakeN, the remaining tokens include the local ones.
+func (r *CounterLimiter) TakeDecision(ctx context.Context, n int) (d ratelimit.Decision, err error) {
+	ctx, span := r.StartSpan(ctx, "ratelimit.Take", ratelimit.AttrN.Int(n))
+	local := false
+	defer func() {
+		r.ObserveDecision(n, d, local, err)
+		ratelimit.EndSpan(span, d, err)
+	}()
+	if r.Closed() {
+		return ratelimit.Decision{}, ratelimit.ErrClosed
+	}
+	if n <= 0 {
+		return ratelimit.Decision{}, ratelimit.ErrInvalidN
+	}
+	duration, throughput := r.limits()
+	// the limit of the key may be overridden, then only the script knows it
+	if n > throughput && r.OverridesKey == "" {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+
 	// 0. Anti DDoS
 	if r.AntiDDoS {
 		if !r.antiDDoSLimiter.Allow() {
-			return false, nil
+			d = r.decision(false)
+			d.Reason = ratelimit.ReasonLocalShield
+			return d, nil
 		}
 	}
 
 	// 1. try to get from local
-	if r.tryTakeFromLocal() {
-		return true, nil
+	if r.tryTakeFromLocal(n) {
+		local = true
+		r.batch.Took(n, true)
+		return r.decision(true), nil
 	}
 
 	// 2. try to get from redis
-	_, err, _ := r.g.Do(r.Key, func() (interface{}, error) {
-		x, err := r.RedisClient.EvalSha(
-			ctx,
-			r.ScriptSHA1,
-			[]string{r.Key},
-			int(r.duration/time.Microsecond),
-			r.throughput,
-			r.batchSize,
-		).Result()
+	_, err, _ = r.g.Do(r.flightKey(n), func() (interface{}, error) {
+		r.Lock()
+		have := r.N
+		r.Unlock()
+		required := int64(n) - have
+		if required <= 0 {
+			return have, nil
+		}
+		var x interface{}
+		start := time.Now()
+		err := r.Fallback.Call(ctx, func() (err error) {
+			x, err = r.EvalScript(
+				ctx,
+				r.OverrideKeys(),
+				int(duration/time.Microsecond),
+				throughput,
+				r.batch.Size(),
+				required,
+			).Result()
+			return err
+		})
 		if err != nil {
+			r.ObserveFetch(0, start, false, err)
 			return 0, err
 		}
+		values := x.([]interface{})
+		r.ObserveFetch(int(values[0].(int64)), start, false, nil)
 		r.Lock()
-		r.N += x.(int64)
+		r.remaining = values[1].(int64)
+		r.limit = values[4].(int64)
+		r.resetAt = time.Now().Add(time.Duration(values[2].(int64)) * time.Microsecond)
+		r.batch.Fetched(values[0].(int64), r.remaining)
+		if values[0].(int64) > 0 {
+			if r.window != values[3].(int64) {
+				// the tokens of the previous window
+				r.N = 0
+			}
+			r.N += values[0].(int64)
+			r.window = values[3].(int64)
+			r.expireAt = r.resetAt
+		}
+		have = r.N
 		r.Unlock()
-		return r.N, nil
+		return have, nil
 	})
 	if err != nil {
-		return false, err
+		return r.Fallback.Decide(n, throughput, err)
+	}
+
+	allowed := r.tryTakeFromLocal(n)
+	if allowed {
+		r.batch.Took(n, false)
+	} else if r.exceeds(n) {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+	return r.decision(allowed), nil
+}
+
+// the settings which can be changed by SetLimit
+func (r *CounterLimiter) limits() (time.Duration, int) {
+	r.Lock()
+	defer r.Unlock()
+	return r.duration, r.throughput
+}
+
+/*
+SetLimit changes the limit to throughput tokens per duration while the limiter is used,
+the anti-DDoS limiter and the in-process fallback follow it.
+The local tokens are kept until their window is over.
+*/
+func (r *CounterLimiter) SetLimit(duration time.Duration, throughput int) error {
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return err
 	}
+	r.Lock()
+	defer r.Unlock()
+	r.duration = duration
+	r.throughput = throughput
+	r.Interval = duration / time.Duration(throughput)
+	r.limit = 0
+	throughputPerSec := ratelimit.PerSecond(throughput, duration)
+	if r.ownAntiDDoS {
+		ratelimit.ResetAntiDDoSLimiter(r.antiDDoSLimiter, throughputPerSec, throughput,
+			r.antiDDoSMultiplier, r.antiDDoSBurst)
+	}
+	r.Fallback.SetLimit(throughputPerSec, throughput)
+	return nil
+}
+
+// SetBatchSize changes the number of tokens fetched at a time, an adaptive batch size stops adapting.
+func (r *CounterLimiter) SetBatchSize(batchSize int) error {
+	if batchSize <= 0 {
+		return errors.New("batchSize must greater than 0")
+	}
+	r.batch.SetSize(batchSize)
+	return nil
+}
 
-	return r.tryTakeFromLocal(), nil
+// Stats shows the fetch sizes and how many takes are served by the local tokens.
+func (r *CounterLimiter) Stats() ratelimit.BatchStats {
+	return r.batch.Stats()
+}
+
+/*
+Close gives the local tokens back to the window they were taken from,
+Take returns ratelimit.ErrClosed after it. It is safe to call Close more than once.
+*/
+func (r *CounterLimiter) Close(ctx context.Context) error {
+	_ = r.BaseRateLimiter.Close(ctx)
+	return r.Flush(ctx)
+}
+
+// Flush gives the local tokens back to the window they were taken from, the limiter can still be used after it.
+func (r *CounterLimiter) Flush(ctx context.Context) error {
+	r.Lock()
+	r.dropExpired(time.Now())
+	refund := r.N
+	window := r.window
+	r.N = 0
+	r.Unlock()
+	if refund <= 0 {
+		return nil
+	}
+	return r.Fallback.Call(ctx, func() error {
+		return r.RunScript(
+			ctx,
+			ratelimit.CounterRefundAlg,
+			[]string{fmt.Sprintf("%s:%d", r.Key, window)},
+			refund,
+		).Err()
+	})
+}
+
+// exceeds tells whether n is greater than the limit of the key which the last fetch saw
+func (r *CounterLimiter) exceeds(n int) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.limit > 0 && int64(n) > r.limit
+}
+
+func (r *CounterLimiter) decision(allowed bool) ratelimit.Decision {
+	r.Lock()
+	defer r.Unlock()
+	d := ratelimit.Decision{
+		Allowed:   allowed,
+		Remaining: int(r.N + r.remaining),
+		Limit:     r.throughput,
+		ResetAt:   r.resetAt,
+	}
+	if r.limit > 0 {
+		d.Limit = int(r.limit)
+	}
+	if !allowed {
+		d.Reason = ratelimit.ReasonQuotaExhausted
+		// the tokens come back in the next window
+		d.RetryAfter = time.Until(r.resetAt)
+		if d.RetryAfter < r.Interval {
+			d.RetryAfter = r.Interval
+		}
+	}
+	return d
+}
+
+/*
+Reserve reserves n tokens in the current window or the next one.
+The reservation is not OK if neither of the windows has enough tokens left,
+or n is greater than the limit, which is throughput unless WithOverrides gives the key another one.
+*/
+func (r *CounterLimiter) Reserve(ctx context.Context, n int) (*ratelimit.Reservation, error) {
+	if r.Closed() {
+		return nil, ratelimit.ErrClosed
+	}
+	if n <= 0 {
+		return nil, ratelimit.ErrInvalidN
+	}
+	duration, throughput := r.limits()
+	if n > throughput && r.OverridesKey == "" {
+		return ratelimit.NewReservation(false, 0, nil), nil
+	}
+
+	// 0. Anti DDoS
+	if r.AntiDDoS {
+		if !r.antiDDoSLimiter.Allow() {
+			return ratelimit.NewReservation(false, 0, nil), nil
+		}
+	}
+
+	// 1. try to get from local
+	if r.tryTakeFromLocal(n) {
+		return ratelimit.NewReservation(true, 0, nil), nil
+	}
+
+	// 2. try to reserve in redis
+	var x interface{}
+	err := r.Fallback.Call(ctx, func() (err error) {
+		x, err = r.RunScript(
+			ctx,
+			ratelimit.CounterReserveAlg,
+			r.OverrideKeys(),
+			int(duration/time.Microsecond),
+			throughput,
+			n,
+		).Result()
+		return err
+	})
+	if err != nil {
+		return r.Fallback.Reserve(n, err)
+	}
+
+	values := x.([]interface{})
+	delay := values[0].(int64)
+	if delay < 0 {
+		return ratelimit.NewReservation(false, 0, nil), nil
+	}
+	windowKey := fmt.Sprintf("%s:%d", r.Key, values[1].(int64))
+	return ratelimit.NewReservation(true, time.Duration(delay)*time.Microsecond,
+		func(ctx context.Context) error {
+			return r.Fallback.Call(ctx, func() error {
+				return r.RunScript(ctx, ratelimit.CounterRefundAlg, []string{windowKey}, n).Err()
+			})
+		}), nil
 }
@@ -0,0 +1,22 @@
+package counter
+
+import (
+	"context"
+	"github.com/vearne/ratelimit"
+	"time"
+)
+
+// localKey is the key of the local limiters, every one of them has a MemoryBackend of its own
+const localKey = "local"
+
+/*
+NewLocal creates a CounterLimiter which works in memory, for a single process.
+It runs the script on a ratelimit.MemoryBackend of its own, one permit at a time, without the anti-DDoS limiter.
+The windows start at the multiples of duration since the Unix epoch, the same as the script.
+opts such as WithName and WithObserver work the same as with redis, WithBackend is ignored.
+*/
+func NewLocal(duration time.Duration, throughput int, opts ...Option) (ratelimit.Limiter, error) {
+	opts = append([]Option{WithAntiDDos(false)}, opts...)
+	opts = append(opts, WithBackend(ratelimit.NewMemoryBackend()))
+	return NewCounterRateLimiter(context.Background(), nil, localKey, duration, throughput, 1, opts...)
+}
@@ -2,17 +2,23 @@ package counter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"golang.org/x/time/rate"
 	"log"
+	"sync"
 	"testing"
 	"time"
 )
 
 const (
 	key     = "key:count"
-	hashVal = "bdbede5669d5e48d6e6c2967aeed2f72f03868ac"
+	hashVal = "28acf538757a6b279524a323e2384ee208d6eb3f"
 )
 
 func MyMatch(expected, actual []interface{}) error {
@@ -32,7 +38,8 @@ func TestTakeFail(t *testing.T) {
 	mock.ExpectPing().SetVal("PONG")
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
-	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2).SetVal(int64(0))
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(500000), int64(1700000000), int64(3)})
 
 	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
 		3,
@@ -60,7 +67,8 @@ func TestTakeSuccess(t *testing.T) {
 	mock.ExpectPing().SetVal("PONG")
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
-	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2).SetVal(int64(1))
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(1), int64(1), int64(500000), int64(1700000000), int64(3)})
 
 	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
 		3,
@@ -88,7 +96,8 @@ func TestContextTimeOut(t *testing.T) {
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true, true})
 	for i := 0; i < 1000; i++ {
-		mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2).SetVal(int64(0))
+		mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2, 1).
+			SetVal([]interface{}{int64(0), int64(0), int64(500000), int64(1700000000), int64(3)})
 	}
 
 	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
@@ -105,3 +114,826 @@ func TestContextTimeOut(t *testing.T) {
 	err = limiter.Wait(waitCtx)
 	assert.Contains(t, err.Error(), "timeout")
 }
+
+func TestTakeN(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	// n is greater than batchSize, fetch all of them at once
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 10, 2, 5).
+		SetVal([]interface{}{int64(5), int64(5), int64(500000), int64(1700000000), int64(10)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		10,
+		2,
+		WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 5)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = ratelimit.TakeN(context.Background(), limiter, 11)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+}
+
+func TestReserve(t *testing.T) {
+	reserveHashVal := "f2f4c32bf3564c17cf39765bd44f99e9226e330f"
+	refundHashVal := "7256bc515fc5de652601189f2b7c7887f09a9815"
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	// reserved in the next window
+	mock.ExpectEvalSha(reserveHashVal, []string{key}, 1000000, 3, 2).
+		SetVal([]interface{}{int64(500000), int64(1700000001)})
+	mock.ExpectEvalSha(refundHashVal, []string{key + ":1700000001"}, 2).SetVal(int64(2))
+	// both windows are full
+	mock.ExpectEvalSha(reserveHashVal, []string{key}, 1000000, 3, 2).
+		SetVal([]interface{}{int64(-1), int64(0)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		2,
+		WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	reserver := limiter.(ratelimit.Reserver)
+
+	r, err := reserver.Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.True(t, r.Delay() > 400*time.Millisecond && r.Delay() <= 500*time.Millisecond)
+	r.Cancel()
+
+	r, err = reserver.Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+	assert.Equal(t, ratelimit.InfDuration, r.Delay())
+
+	r, err = reserver.Reserve(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+}
+
+func TestTakeDecision(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(2), int64(1), int64(500000), int64(1700000000), int64(3)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(400000), int64(1700000000), int64(3)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		2,
+		WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	// 1 local token and 1 in redis
+	assert.Equal(t, 2, d.Remaining)
+	assert.Equal(t, 3, d.Limit)
+	assert.True(t, time.Until(d.ResetAt) <= 500*time.Millisecond)
+	assert.Equal(t, time.Duration(0), d.RetryAfter)
+
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+	assert.True(t, d.RetryAfter > 300*time.Millisecond && d.RetryAfter <= 400*time.Millisecond)
+}
+
+func TestKeyed(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	// only once for all the keys
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+
+	mock.ExpectEvalSha(hashVal, []string{key + ":user1"}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(2), int64(1), int64(500000), int64(1700000000), int64(3)})
+	mock.ExpectEvalSha(hashVal, []string{key + ":user2"}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(500000), int64(1700000000), int64(3)})
+
+	limiter, err := NewKeyedCounterRateLimiter(context.Background(), db, key+":", time.Second,
+		3,
+		2,
+		100,
+		WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := limiter.Take(context.Background(), "user1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = limiter.Take(context.Background(), "user2")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	// the local token of user1
+	ok, err = limiter.Take(context.Background(), "user1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, limiter.Len())
+}
+
+func TestDegradation(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetErr(errors.New("connection refused"))
+	// the probe after redis is unavailable
+	mock.ExpectScriptExists(hashVal).SetErr(errors.New("connection refused"))
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{false})
+	mock.ExpectScriptLoad(ratelimit.AlgMap[ratelimit.CounterAlg]).SetVal(hashVal)
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(2), int64(1), int64(500000), int64(1700000000), int64(3)})
+
+	breaker := ratelimit.NewCircuitBreaker(1, 100*time.Millisecond)
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		2,
+		WithAntiDDos(false),
+		WithDegradation(ratelimit.Degradation{Mode: ratelimit.FailClosed, Breaker: breaker}))
+	// the constructor doesn't fail without redis
+	assert.Nil(t, err)
+	assert.True(t, breaker.Open())
+
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	// redis isn't called during the cooldown
+	ok, err = limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	time.Sleep(100 * time.Millisecond)
+	ok, err = limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, breaker.Open())
+}
+
+func TestFailLocal(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	for i := 0; i < 3; i++ {
+		mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 4, 1, 1).
+			SetErr(errors.New("connection refused"))
+	}
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		4,
+		1,
+		WithAntiDDos(false),
+		WithDegradation(ratelimit.Degradation{Mode: ratelimit.FailLocal, LocalShare: 0.5}))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	// half of the throughput is allowed locally
+	for _, expected := range []bool{true, true, false} {
+		ok, err := limiter.Take(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, expected, ok)
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (redisError) RedisError() {}
+
+func TestNoScript(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	// redis restarts and the script is lost
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2, 1).
+		SetErr(redisError("NOSCRIPT No matching script. Please use EVAL."))
+	mock.ExpectEval(ratelimit.AlgMap[ratelimit.CounterAlg], []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(2), int64(1), int64(500000), int64(1700000000), int64(3)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		2,
+		WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestPureEval(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	// SCRIPT EXISTS and SCRIPT LOAD are not called
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectEval(ratelimit.AlgMap[ratelimit.CounterAlg], []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(2), int64(1), int64(500000), int64(1700000000), int64(3)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		2,
+		WithAntiDDos(false),
+		WithPureEval(true))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestFunctions(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectFunctionLoadReplace(ratelimit.LibraryCode()).SetVal(ratelimit.LibraryName())
+	mock.ExpectFCall(ratelimit.FunctionName(ratelimit.CounterAlg), []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(2), int64(1), int64(500000), int64(1700000000), int64(3)})
+	// FUNCTION FLUSH, the library is loaded again
+	mock.ExpectFCall(ratelimit.FunctionName(ratelimit.CounterAlg), []string{key}, 1000000, 3, 2, 1).
+		SetErr(redisError("ERR Function not found"))
+	mock.ExpectFunctionLoadReplace(ratelimit.LibraryCode()).SetVal(ratelimit.LibraryName())
+	mock.ExpectFCall(ratelimit.FunctionName(ratelimit.CounterAlg), []string{key}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(1), int64(0), int64(400000), int64(1700000000), int64(3)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		2,
+		WithAntiDDos(false),
+		WithFunctions(true))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		ok, err := limiter.Take(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+}
+
+func TestDurations(t *testing.T) {
+	cases := []struct {
+		duration   time.Duration
+		throughput int
+		unit       int
+	}{
+		// 50 per 250ms
+		{250 * time.Millisecond, 50, 250000},
+		// 90 per 1.5s
+		{1500 * time.Millisecond, 90, 1500000},
+		{time.Millisecond, 1, 1000},
+		{time.Hour, 100, 3600000000},
+	}
+	for _, c := range cases {
+		db, mock := redismock.NewClientMock()
+
+		mock = mock.CustomMatch(MyMatch)
+		mock.ExpectPing().SetVal("PONG")
+		mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+		mock.ExpectEvalSha(hashVal, []string{key}, c.unit, c.throughput, 1, 1).
+			SetVal([]interface{}{int64(1), int64(c.throughput - 1), int64(c.unit / 2), int64(1700000000), int64(c.throughput)})
+
+		// the anti DDoS limiter works with any duration
+		limiter, err := NewCounterRateLimiter(context.Background(), db, key, c.duration,
+			c.throughput,
+			1)
+		if err != nil {
+			t.Errorf("unexpected error, %v", err)
+			return
+		}
+
+		ok, err := limiter.Take(context.Background())
+		assert.Nil(t, err, c.duration)
+		assert.True(t, ok, c.duration)
+	}
+}
+
+func TestClose(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 3, 1).
+		SetVal([]interface{}{int64(3), int64(0), int64(500000), int64(1700000000), int64(3)})
+	// the 2 local tokens are given back to the window they were taken from
+	mock.ExpectEvalSha(ratelimit.ScriptSHA1(ratelimit.CounterRefundAlg), []string{key + ":1700000000"}, 2).
+		SetVal(int64(2))
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		3,
+		WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Nil(t, ratelimit.Close(context.Background(), limiter))
+	// nothing is left to give back
+	assert.Nil(t, ratelimit.Close(context.Background(), limiter))
+
+	_, err = limiter.Take(context.Background())
+	assert.ErrorIs(t, err, ratelimit.ErrClosed)
+}
+
+func TestLocalTokensExpire(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 3, 1).
+		SetVal([]interface{}{int64(3), int64(0), int64(50000), int64(1700000000), int64(3)})
+	// the local tokens of the previous window are dropped
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 3, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(950000), int64(1700000001), int64(3)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		3,
+		WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	time.Sleep(60 * time.Millisecond)
+	ok, err = limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestAdaptiveBatch(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	// start with min
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 100, 1, 1).
+		SetVal([]interface{}{int64(1), int64(99), int64(500000), int64(1700000000), int64(100)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 100, 1, 1).
+		SetVal([]interface{}{int64(1), int64(98), int64(500000), int64(1700000000), int64(100)})
+	// consumed quickly, grow to max
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 100, 10, 1).
+		SetVal([]interface{}{int64(10), int64(4), int64(500000), int64(1700000000), int64(100)})
+	// at most half of the remaining tokens
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 100, 2, 1).
+		SetVal([]interface{}{int64(2), int64(2), int64(500000), int64(1700000000), int64(100)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		100,
+		5,
+		WithAntiDDos(false), WithAdaptiveBatch(1, 10))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	for i := 0; i < 13; i++ {
+		ok, err := limiter.Take(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	stats := limiter.(ratelimit.BatchStater).Stats()
+	assert.Equal(t, int64(13), stats.Takes)
+	assert.Equal(t, int64(9), stats.LocalHits)
+	assert.Equal(t, int64(4), stats.Fetches)
+	assert.Equal(t, int64(14), stats.FetchedTokens)
+	assert.Equal(t, 2, stats.LastFetchSize)
+	assert.Equal(t, 1, stats.BatchSize)
+	assert.InDelta(t, 9.0/13, stats.HitRatio(), 0.001)
+}
+
+func TestAntiDDoS(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 1, 1).
+		SetVal([]interface{}{int64(1), int64(2), int64(500000), int64(1700000000), int64(3)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 1, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(500000), int64(1700000000), int64(3)})
+
+	// 2 requests, and never refilled
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		1,
+		WithAntiDDoSLimiter(rate.NewLimiter(0, 2)))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, ratelimit.ReasonNone, d.Reason)
+
+	d, err = taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ratelimit.ReasonQuotaExhausted, d.Reason)
+
+	// redis is not requested
+	d, err = taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ratelimit.ReasonLocalShield, d.Reason)
+
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	limiter, err = NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		1,
+		WithAntiDDos(false))
+	assert.Nil(t, err)
+	assert.Nil(t, limiter.(*CounterLimiter).antiDDoSLimiter)
+}
+
+func TestNew(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 60000000, 200, 10, 1).
+		SetVal([]interface{}{int64(10), int64(190), int64(30000000), int64(1700000000), int64(200)})
+
+	limiter, err := ratelimit.New(context.Background(), db, ratelimit.Config{
+		Algorithm: "counter",
+		Key:       key,
+		Rate:      "200/1m",
+		Batch:     10,
+	})
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(9), limiter.(*CounterLimiter).N)
+
+	var configErr *ratelimit.ConfigError
+	_, err = ratelimit.New(context.Background(), db, ratelimit.Config{Algorithm: "counter", Rate: "200/1m"})
+	assert.ErrorAs(t, err, &configErr)
+	assert.Equal(t, "key", configErr.Field)
+
+	_, err = ratelimit.New(context.Background(), db, ratelimit.Config{Algorithm: "counter", Key: key,
+		Rate: "200/1m", Burst: 10})
+	assert.ErrorAs(t, err, &configErr)
+	assert.Equal(t, "burst", configErr.Field)
+	assert.Equal(t, "invalid burst: it is not supported by counter", err.Error())
+}
+
+func TestSetLimit(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 60000000, 100, 4, 1).
+		SetVal([]interface{}{int64(4), int64(96), int64(30000000), int64(1700000000), int64(100)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		1)
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	r := limiter.(*CounterLimiter)
+
+	assert.Nil(t, r.SetLimit(time.Minute, 100))
+	assert.Nil(t, r.SetBatchSize(4))
+	assert.Equal(t, 600*time.Millisecond, r.WaitInterval())
+	assert.InDelta(t, float64(100)/60*2, float64(r.antiDDoSLimiter.Limit()), 0.0001)
+	assert.Equal(t, 200, r.antiDDoSLimiter.Burst())
+
+	d, err := r.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 100, d.Limit)
+	assert.Equal(t, int64(3), r.N)
+
+	assert.NotNil(t, r.SetLimit(time.Microsecond, 100))
+	assert.NotNil(t, r.SetBatchSize(-1))
+}
+
+func TestLocal(t *testing.T) {
+	limiter, err := NewLocal(time.Hour, 3)
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ratelimit.ReasonQuotaExhausted, d.Reason)
+	// at least an interval, the same as with redis
+	assert.Equal(t, max(time.Until(d.ResetAt), 20*time.Minute).Round(time.Second), d.RetryAfter.Round(time.Second))
+
+	_, err = ratelimit.TakeN(context.Background(), limiter, 4)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+
+	// the next window
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 3)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.True(t, r.Delay() > 0)
+	r.Cancel()
+	r, err = limiter.(ratelimit.Reserver).Reserve(context.Background(), 3)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	r, err = limiter.(ratelimit.Reserver).Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+
+	assert.Nil(t, ratelimit.Close(context.Background(), limiter))
+	_, err = limiter.Take(context.Background())
+	assert.Equal(t, ratelimit.ErrClosed, err)
+
+	limiter, err = ratelimit.New(context.Background(), nil, ratelimit.Config{
+		Algorithm: "counter",
+		Rate:      "3/h",
+		Batch:     2,
+		Name:      "api",
+		Local:     true,
+	})
+	assert.Nil(t, err)
+	assert.IsType(t, &CounterLimiter{}, limiter)
+	assert.Equal(t, "api", limiter.(*CounterLimiter).Name)
+}
+
+func TestMemoryBackend(t *testing.T) {
+	backend := ratelimit.NewMemoryBackend()
+	limiter, err := NewCounterRateLimiter(context.Background(), nil, key, time.Hour,
+		3,
+		2,
+		WithAntiDDos(false), WithBackend(backend))
+	assert.Nil(t, err)
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = ratelimit.TakeN(context.Background(), limiter, 2)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// the permits in the next window are given back
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 3)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.True(t, r.Delay() > 0)
+	r.Cancel()
+	r, err = limiter.(ratelimit.Reserver).Reserve(context.Background(), 3)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.Equal(t, 2, backend.Len())
+}
+
+// scripter runs the scripts with go-redis, like an adapter of another client
+type scripter struct {
+	client redis.Cmdable
+}
+
+func (s scripter) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return s.client.Eval(ctx, script, keys, args...).Result()
+}
+
+func (s scripter) EvalSha(ctx context.Context, sha1 string, keys []string,
+	args ...interface{}) (interface{}, error) {
+	return s.client.EvalSha(ctx, sha1, keys, args...).Result()
+}
+
+func TestScripterBackend(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	// nothing is loaded by the constructor
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2, 2).
+		SetErr(errors.New("NOSCRIPT No matching script. Please use EVAL."))
+	mock.ExpectEval(ratelimit.AlgMap[ratelimit.CounterAlg], []string{key}, 1000000, 3, 2, 2).
+		SetVal([]interface{}{int64(2), int64(1), int64(500000), int64(1700000000), int64(3)})
+
+	limiter, err := NewCounterRateLimiter(context.Background(), nil, key, time.Second,
+		3,
+		2,
+		WithAntiDDos(false), WithBackend(ratelimit.NewScripterBackend(scripter{db})))
+	assert.Nil(t, err)
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestKeyedEviction(t *testing.T) {
+	backend := ratelimit.NewMemoryBackend()
+	limiter, err := NewKeyedCounterRateLimiter(context.Background(), nil, key+":", time.Hour,
+		3,
+		2,
+		1,
+		WithAntiDDos(false), WithBackend(backend))
+	assert.Nil(t, err)
+
+	user1 := limiter.Get("user1")
+	ok, err := user1.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	// user1 is evicted, but it is still usable
+	_, err = limiter.Take(context.Background(), "user2")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, limiter.Len())
+	// the local token of user1 is given back, then 2 tokens are left in the window
+	assert.Eventually(t, func() bool {
+		ok, err := ratelimit.TakeN(context.Background(), limiter.Get("user1"), 2)
+		return err == nil && ok
+	}, time.Second, 10*time.Millisecond)
+	_, err = user1.Take(context.Background())
+	assert.Nil(t, err)
+
+	// the keys push each other out all the time
+	var wg sync.WaitGroup
+	for _, user := range []string{"user4", "user5"} {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := limiter.Take(context.Background(), user)
+				assert.Nil(t, err)
+			}
+		}(user)
+	}
+	wg.Wait()
+}
+
+func TestKeyedMaxKeys(t *testing.T) {
+	for _, maxKeys := range []int{0, -1} {
+		_, err := NewKeyedCounterRateLimiter(context.Background(), nil, key+":", time.Second,
+			3,
+			2,
+			maxKeys,
+			WithBackend(ratelimit.NewMemoryBackend()))
+		assert.NotNil(t, err)
+	}
+
+	_, err := ratelimit.NewKeyedLimiter(0, func(key string) ratelimit.Limiter {
+		return nil
+	})
+	assert.NotNil(t, err)
+}
+
+func TestCheckLimit(t *testing.T) {
+	// the error of ratelimit.CheckLimit is returned
+	_, err := NewCounterRateLimiter(context.Background(), nil, key, time.Microsecond, 10, 1)
+	assert.NotNil(t, err)
+}
+
+// TestFlightKey takes more tokens while a fetch of fewer is in flight, it must not join that fetch.
+func TestFlightKey(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	limiter, err := NewCounterRateLimiter(context.Background(), client, key, time.Second, 10, 1,
+		WithAntiDDos(false))
+	assert.Nil(t, err)
+	r := limiter.(*CounterLimiter)
+
+	block := make(chan struct{})
+	go r.g.Do(r.flightKey(1), func() (interface{}, error) {
+		<-block
+		return int64(0), nil
+	})
+	defer close(block)
+	time.Sleep(10 * time.Millisecond)
+
+	result := make(chan bool)
+	go func() {
+		ok, _ := limiter.(ratelimit.MultiTaker).TakeN(context.Background(), 3)
+		result <- ok
+	}()
+	select {
+	case ok := <-result:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Error("TakeN joined the fetch of 1 token")
+	}
+}
+
+// TestOverridesLimit gives the key a larger limit than the one of the constructor.
+func TestOverridesLimit(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	overrides := ratelimit.NewOverrides(client, ratelimit.DefaultOverridesKey)
+	err := overrides.Set(context.Background(), key, ratelimit.Override{Duration: time.Second, Throughput: 10})
+	assert.Nil(t, err)
+	limiter, err := NewCounterRateLimiter(context.Background(), client, key, time.Second, 2, 1,
+		WithAntiDDos(false), WithOverrides(ratelimit.DefaultOverridesKey))
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 5)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 10, d.Limit)
+	_, err = taker.TakeDecision(context.Background(), 11)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	r, err = limiter.(ratelimit.Reserver).Reserve(context.Background(), 11)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+}
+
+func TestCancelBreaker(t *testing.T) {
+	reserveHashVal := "f2f4c32bf3564c17cf39765bd44f99e9226e330f"
+	refundHashVal := "7256bc515fc5de652601189f2b7c7887f09a9815"
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(reserveHashVal, []string{key}, 1000000, 3, 2).
+		SetVal([]interface{}{int64(500000), int64(1700000001)})
+	mock.ExpectEvalSha(refundHashVal, []string{key + ":1700000001"}, 2).
+		SetErr(errors.New("connection refused"))
+
+	breaker := ratelimit.NewCircuitBreaker(1, time.Minute)
+	limiter, err := NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		2,
+		WithAntiDDos(false),
+		WithDegradation(ratelimit.Degradation{Mode: ratelimit.FailClosed, Breaker: breaker}))
+	assert.Nil(t, err)
+
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	// the refund fails like the other requests to redis
+	r.Cancel()
+	assert.True(t, breaker.Open())
+}
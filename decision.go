@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// DecisionTaker is implemented by the limiters which are able to describe their state
+// together with the result of taking permits.
+type DecisionTaker interface {
+	// TakeDecision works like TakeN, and returns the state of the limiter.
+	TakeDecision(ctx context.Context, n int) (Decision, error)
+}
+
+// Decision is the result of taking permits, it carries everything needed by
+// the headers such as X-RateLimit-Remaining, RateLimit-Reset and Retry-After.
+type Decision struct {
+	Allowed bool
+	// The number of permits which can still be taken,
+	// for the limiters which fetch permits in batches, it includes the local ones.
+	Remaining int
+	// The maximum number of permits which can be taken at once.
+	Limit int
+	// The time when the limiter is fully available again.
+	ResetAt time.Time
+	// How long to wait before retrying, zero if Allowed.
+	RetryAfter time.Duration
+	// Why the permits are rejected, ReasonNone if Allowed.
+	Reason Reason
+}
+
+// Reason tells why permits are rejected.
+type Reason int
+
+const (
+	ReasonNone Reason = iota
+	// ReasonQuotaExhausted means the quota shared by all the instances is used up.
+	ReasonQuotaExhausted
+	// ReasonLocalShield means the local anti-DDoS limiter rejects the request before redis is requested.
+	ReasonLocalShield
+	// ReasonDegraded means redis is unavailable, and the request is rejected by the degradation.
+	ReasonDegraded
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonNone:
+		return "none"
+	case ReasonQuotaExhausted:
+		return "quota_exhausted"
+	case ReasonLocalShield:
+		return "local_shield"
+	case ReasonDegraded:
+		return "degraded"
+	}
+	return "unknown"
+}
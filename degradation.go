@@ -0,0 +1,261 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	slog "github.com/vearne/simplelog"
+	"golang.org/x/time/rate"
+	"math"
+	"sync"
+	"time"
+)
+
+// FailureMode decides what a limiter does when redis is unavailable.
+type FailureMode int
+
+const (
+	// FailError returns the error of redis to the caller, it is the default.
+	FailError FailureMode = iota
+	// FailOpen allows all the requests.
+	FailOpen
+	// FailClosed denies all the requests.
+	FailClosed
+	// FailLocal falls back to an in-process limiter sized to a share of the global rate.
+	FailLocal
+)
+
+const (
+	DefaultFailureThreshold = 5
+	DefaultCooldown         = time.Second
+)
+
+// ErrCircuitOpen is returned in FailError mode while the circuit breaker stops calling redis.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Degradation configures what a limiter does when redis is unavailable.
+type Degradation struct {
+	Mode FailureMode
+	// LocalShare is the share of the global rate used by the in-process limiter in FailLocal mode,
+	// usually 1 / the number of instances, 1 by default.
+	LocalShare float64
+	// Breaker stops calling redis while it is unhealthy,
+	// the limiters created by the same constructor share one by default.
+	Breaker *CircuitBreaker
+}
+
+/*
+CircuitBreaker opens after threshold consecutive failures, then redis is not called for cooldown.
+After that, a single call probes redis, the breaker closes if it succeeds, otherwise it opens again.
+*/
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Open returns whether redis is considered unhealthy.
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
+
+// allow returns ErrCircuitOpen if redis shouldn't be called, probing is true if the call is a probe.
+func (b *CircuitBreaker) allow() (probing bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return false, nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false, ErrCircuitOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// Trip opens the breaker at once, the next call probes redis.
+func (b *CircuitBreaker) Trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = b.threshold
+	b.openedAt = time.Time{}
+}
+
+func (b *CircuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+/*
+Fallback applies a Degradation to a limiter, a nil Fallback just returns the errors.
+Every limiter has its own Fallback, because the in-process limiter belongs to a key.
+*/
+type Fallback struct {
+	mode    FailureMode
+	breaker *CircuitBreaker
+	local   *rate.Limiter
+	share   float64
+	// prepare redis before probing it, such as loading the script which may be lost
+	probe func(ctx context.Context) error
+}
+
+/*
+NewFallback creates a Fallback, limit and burst describe the global rate,
+the in-process limiter gets d.LocalShare of them.
+*/
+func NewFallback(d Degradation, limit rate.Limit, burst int, probe func(ctx context.Context) error) *Fallback {
+	f := Fallback{mode: d.Mode, breaker: d.Breaker, probe: probe}
+	if f.breaker == nil {
+		f.breaker = NewCircuitBreaker(DefaultFailureThreshold, DefaultCooldown)
+	}
+	if d.Mode == FailLocal {
+		share := d.LocalShare
+		if share <= 0 {
+			share = 1
+		}
+		f.share = share
+		f.local = rate.NewLimiter(limit*rate.Limit(share), int(math.Max(1, math.Ceil(float64(burst)*share))))
+	}
+	return &f
+}
+
+// SetLimit changes the global rate which the in-process limiter gets a share of.
+func (f *Fallback) SetLimit(limit rate.Limit, burst int) {
+	if f == nil || f.local == nil {
+		return
+	}
+	f.local.SetLimit(limit * rate.Limit(f.share))
+	f.local.SetBurst(int(math.Max(1, math.Ceil(float64(burst)*f.share))))
+}
+
+// Call calls redis with fn unless the circuit breaker is open, the result is recorded by the breaker.
+func (f *Fallback) Call(ctx context.Context, fn func() error) error {
+	if f == nil {
+		return fn()
+	}
+	probing, err := f.breaker.allow()
+	if err != nil {
+		return err
+	}
+	if probing && f.probe != nil {
+		err = f.probe(ctx)
+		if err != nil {
+			f.breaker.failure()
+			return err
+		}
+	}
+
+	err = fn()
+	switch {
+	case err == nil:
+		f.breaker.success()
+	case probing || ctx.Err() == nil:
+		// the caller giving up says nothing about redis, unless it is a probe
+		f.breaker.failure()
+	}
+	return err
+}
+
+// Decide returns the decision of n permits when redis fails with err, limit is the Limit of the decision.
+func (f *Fallback) Decide(n int, limit int, err error) (Decision, error) {
+	if f == nil || f.mode == FailError {
+		return Decision{}, err
+	}
+	slog.Warn("redis is unavailable, degrade:%v", err)
+
+	now := time.Now()
+	switch f.mode {
+	case FailOpen:
+		return Decision{Allowed: true, Remaining: limit, Limit: limit, ResetAt: now}, nil
+	case FailLocal:
+		r := f.local.ReserveN(now, n)
+		if r.OK() {
+			delay := r.DelayFrom(now)
+			if delay == 0 {
+				return Decision{Allowed: true, Remaining: int(f.local.TokensAt(now)), Limit: limit, ResetAt: now}, nil
+			}
+			r.CancelAt(now)
+			return Decision{Limit: limit, ResetAt: now.Add(delay), RetryAfter: delay, Reason: ReasonDegraded}, nil
+		}
+	}
+	// FailClosed, or n is larger than the burst of the local limiter
+	return Decision{Limit: limit, ResetAt: now.Add(f.breaker.cooldown), RetryAfter: f.breaker.cooldown,
+		Reason: ReasonDegraded}, nil
+}
+
+// Reserve works like Decide, for the limiters which are able to reserve permits.
+func (f *Fallback) Reserve(n int, err error) (*Reservation, error) {
+	if f == nil || f.mode == FailError {
+		return nil, err
+	}
+	slog.Warn("redis is unavailable, degrade:%v", err)
+
+	switch f.mode {
+	case FailOpen:
+		return NewReservation(true, 0, nil), nil
+	case FailLocal:
+		now := time.Now()
+		r := f.local.ReserveN(now, n)
+		if r.OK() {
+			return NewReservation(true, r.DelayFrom(now), func(ctx context.Context) error {
+				r.Cancel()
+				return nil
+			}), nil
+		}
+	}
+	return NewReservation(false, 0, nil), nil
+}
+
+// ScriptProbe returns a probe for NewFallback which loads the scripts of algs as mode says.
+func ScriptProbe(client redis.Cmdable, mode ScriptMode, algs ...int) func(ctx context.Context) error {
+	switch mode {
+	case EvalMode:
+		// EVAL doesn't need the scripts to be loaded
+		return nil
+	case FunctionMode:
+		return func(ctx context.Context) error {
+			return LoadLibrary(ctx, client)
+		}
+	}
+	return func(ctx context.Context) error {
+		for _, alg := range algs {
+			_, err := LoadScript(ctx, client, alg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Degraded returns whether redis errors are tolerated, then the constructors don't fail without redis.
+func (d *Degradation) Degraded() bool {
+	return d != nil && d.Mode != FailError
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+LibraryVersion is the version of the function library, it changes whenever a script changes.
+Every version is a library of its own, so the instances of different versions can share one redis.
+*/
+const LibraryVersion = 8
+
+// libraryCodeSHA1 is the SHA1 of LibraryCode of LibraryVersion, a test fails if the code changes without them.
+const libraryCodeSHA1 = "83f529d90d2e52309e9da5f4e72314d9abca100f"
+
+const libraryPrefix = "vearne_ratelimit_v"
+
+var algNames = map[int]string{
+	TokenBucketAlg:        "token_bucket",
+	CounterAlg:            "counter",
+	LeakyBucketAlg:        "leaky_bucket",
+	CounterReserveAlg:     "counter_reserve",
+	TokenBucketReserveAlg: "token_bucket_reserve",
+	LeakyBucketReserveAlg: "leaky_bucket_reserve",
+	LeakyBucketCancelAlg:  "leaky_bucket_cancel",
+	SlidingLogAlg:         "sliding_log",
+	SlidingWindowAlg:      "sliding_window",
+	GCRAAlg:               "gcra",
+	ConcurrencyAcquireAlg: "concurrency_acquire",
+	ConcurrencyRenewAlg:   "concurrency_renew",
+	CounterRefundAlg:      "counter_refund",
+	TokenBucketRefundAlg:  "token_bucket_refund",
+	ConcurrencyReleaseAlg: "concurrency_release",
+	TokenBucketCancelAlg:  "token_bucket_cancel",
+}
+
+// redis.replicate_commands() is deprecated, and it isn't available in functions
+var replicateCommands = regexp.MustCompile(`[ \t]*redis\.replicate_commands\(\);?\n`)
+
+// AlgName returns the name of alg, such as "counter" and "token_bucket".
+func AlgName(alg int) string {
+	name, ok := algNames[alg]
+	if !ok {
+		return strconv.Itoa(alg)
+	}
+	return name
+}
+
+// LibraryName returns the name of the function library of LibraryVersion.
+func LibraryName() string {
+	return libraryPrefix + strconv.Itoa(LibraryVersion)
+}
+
+// FunctionName returns the name of the function of alg in the library.
+func FunctionName(alg int) string {
+	return LibraryName() + "_" + AlgName(alg)
+}
+
+// LibraryCode returns the code of the library which registers all the scripts in AlgMap as functions.
+func LibraryCode() string {
+	algs := make([]int, 0, len(AlgMap))
+	for alg := range AlgMap {
+		algs = append(algs, alg)
+	}
+	sort.Ints(algs)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!lua name=%s\n", LibraryName())
+	for _, alg := range algs {
+		// the scripts read KEYS and ARGV, they become the arguments of the functions
+		fmt.Fprintf(&b, "\nredis.register_function('%s', function(KEYS, ARGV)\n", FunctionName(alg))
+		b.WriteString(replicateCommands.ReplaceAllString(AlgMap[alg], ""))
+		b.WriteString("end)\n")
+	}
+	return b.String()
+}
+
+// LoadLibrary registers the library with FUNCTION LOAD REPLACE, Redis 7 is required.
+func LoadLibrary(ctx context.Context, client redis.Cmdable) error {
+	return client.FunctionLoadReplace(ctx, LibraryCode()).Err()
+}
+
+// InstalledLibraryVersions returns the versions of the libraries which have been loaded into redis.
+func InstalledLibraryVersions(ctx context.Context, client redis.Cmdable) ([]int, error) {
+	libs, err := client.FunctionList(ctx, redis.FunctionListQuery{LibraryNamePattern: libraryPrefix + "*"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int, 0, len(libs))
+	for _, lib := range libs {
+		version, err := strconv.Atoi(strings.TrimPrefix(lib.Name, libraryPrefix))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
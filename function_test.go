@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestLibraryVersion fails when a script changes, then LibraryVersion must be bumped and libraryCodeSHA1 updated,
+// otherwise the servers would keep the library of the old scripts under the same name.
+func TestLibraryVersion(t *testing.T) {
+	code := LibraryCode()
+	assert.Equal(t, libraryCodeSHA1, fmt.Sprintf("%x", sha1.Sum([]byte(code))),
+		"the library has changed, bump LibraryVersion and update libraryCodeSHA1")
+}
+
+// TestLibraryCode compiles the library with a Lua 5.1 interpreter like the one of redis,
+// and checks that it registers a function for every script.
+func TestLibraryCode(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	var names []string
+	redis := L.NewTable()
+	L.SetField(redis, "register_function", L.NewFunction(func(L *lua.LState) int {
+		names = append(names, L.CheckString(1))
+		L.CheckFunction(2)
+		return 0
+	}))
+	L.SetGlobal("redis", redis)
+
+	code := LibraryCode()
+	// the first line is the shebang of FUNCTION LOAD
+	shebang, body, _ := strings.Cut(code, "\n")
+	assert.Equal(t, "#!lua name="+LibraryName(), shebang)
+	assert.Nil(t, L.DoString(body))
+
+	expected := make([]string, 0, len(AlgMap))
+	for alg := range AlgMap {
+		expected = append(expected, FunctionName(alg))
+	}
+	sort.Strings(expected)
+	sort.Strings(names)
+	assert.Equal(t, expected, names)
+}
@@ -0,0 +1,337 @@
+package gcra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+	slog "github.com/vearne/simplelog"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+/*
+GCRALimiter implements the generic cell rate algorithm,
+only a timestamp is stored in redis for every key.
+throughput permits are allowed in duration, and at most burst permits can be taken at once.
+*/
+type GCRALimiter struct {
+	ratelimit.BaseRateLimiter
+
+	burst int
+
+	/*
+		If the traffic is too large, the limiter will request Redis frequently.
+		To avoid this situation, the frequency of accessing Redis will be limited.
+	*/
+	AntiDDoS           bool
+	antiDDoSLimiter    *rate.Limiter
+	antiDDoSMultiplier float64
+	antiDDoSBurst      int
+
+	degradation *ratelimit.Degradation
+}
+
+type Option func(*GCRALimiter)
+
+func NewGCRALimiter(ctx context.Context, client redis.Cmdable, key string, duration time.Duration,
+	throughput int, burst int, opts ...Option) (ratelimit.Limiter, error) {
+
+	newLimiter, err := prepare(ctx, client, duration, throughput, burst, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newLimiter(key), nil
+}
+
+/*
+NewKeyedGCRALimiter creates a limiter which limits every key separately,
+the key in redis is keyPrefix + key, and at most maxKeys limiters are kept in memory.
+*/
+func NewKeyedGCRALimiter(ctx context.Context, client redis.Cmdable, keyPrefix string,
+	duration time.Duration, throughput int, burst int,
+	maxKeys int, opts ...Option) (*ratelimit.KeyedLimiter, error) {
+
+	if maxKeys <= 0 {
+		return nil, errors.New("maxKeys must greater than 0")
+	}
+
+	newLimiter, err := prepare(ctx, client, duration, throughput, burst, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ratelimit.NewKeyedLimiter(maxKeys, func(key string) ratelimit.Limiter {
+		return newLimiter(keyPrefix + key)
+	})
+}
+
+// check the arguments and load the script once, then limiters of different keys can be created cheaply
+func prepare(ctx context.Context, client redis.Cmdable, duration time.Duration,
+	throughput int, burst int, opts ...Option) (func(key string) *GCRALimiter, error) {
+
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return nil, err
+	}
+
+	if burst <= 0 {
+		return nil, errors.New("burst must greater than 0")
+	}
+
+	degradation, mode, backend := presetOf(opts)
+	scriptSHA1, err := ratelimit.PrepareBackend(ctx, client, backend, ratelimit.GCRAAlg, degradation, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(key string) *GCRALimiter {
+		r := GCRALimiter{
+			BaseRateLimiter: ratelimit.BaseRateLimiter{RedisClient: client, ScriptSHA1: scriptSHA1, Key: key},
+			burst:           burst,
+			AntiDDoS:        true,
+		}
+		r.Alg = ratelimit.GCRAAlg
+		r.Interval = duration / time.Duration(throughput)
+
+		// Loop through each option
+		for _, opt := range opts {
+			// Call the option giving the instantiated
+			opt(&r)
+		}
+
+		throughputPerSec := ratelimit.PerSecond(throughput, duration)
+		if r.AntiDDoS && r.antiDDoSLimiter == nil {
+			r.antiDDoSLimiter = ratelimit.NewAntiDDoSLimiter(throughputPerSec, throughput,
+				r.antiDDoSMultiplier, r.antiDDoSBurst)
+		}
+
+		if degradation != nil {
+			probe := ratelimit.BackendProbe(client, backend, mode, ratelimit.GCRAAlg)
+			r.Fallback = ratelimit.NewFallback(*degradation, throughputPerSec,
+				burst, probe)
+		}
+		return &r
+	}, nil
+}
+
+// the options which are needed before the limiters are created, the keys share the circuit breaker
+func presetOf(opts []Option) (*ratelimit.Degradation, ratelimit.ScriptMode, ratelimit.Backend) {
+	var r GCRALimiter
+	for _, opt := range opts {
+		opt(&r)
+	}
+	if r.degradation == nil {
+		return nil, r.ScriptMode(), r.Backend
+	}
+	d := *r.degradation
+	if d.Breaker == nil {
+		d.Breaker = ratelimit.NewCircuitBreaker(ratelimit.DefaultFailureThreshold, ratelimit.DefaultCooldown)
+	}
+	return &d, r.ScriptMode(), r.Backend
+}
+
+func WithAntiDDos(antiDDoS bool) Option {
+	return func(r *GCRALimiter) {
+		r.AntiDDoS = antiDDoS
+	}
+}
+
+// WithAntiDDoSMultiplier sets how many times the throughput the local anti-DDoS limiter allows, 2 by default.
+func WithAntiDDoSMultiplier(multiplier float64) Option {
+	return func(r *GCRALimiter) {
+		r.antiDDoSMultiplier = multiplier
+	}
+}
+
+// WithAntiDDoSBurst sets how many requests the local anti-DDoS limiter allows at once.
+func WithAntiDDoSBurst(burst int) Option {
+	return func(r *GCRALimiter) {
+		r.antiDDoSBurst = burst
+	}
+}
+
+// WithAntiDDoSLimiter replaces the local anti-DDoS limiter, it is shared by all the keys of a keyed limiter.
+func WithAntiDDoSLimiter(limiter *rate.Limiter) Option {
+	return func(r *GCRALimiter) {
+		r.AntiDDoS = true
+		r.antiDDoSLimiter = limiter
+	}
+}
+
+// WithDegradation decides what to do when redis is unavailable, the errors are returned by default.
+func WithDegradation(d ratelimit.Degradation) Option {
+	return func(r *GCRALimiter) {
+		r.degradation = &d
+	}
+}
+
+// WithName sets the name of the limiter which is given to the Observer.
+func WithName(name string) Option {
+	return func(r *GCRALimiter) {
+		r.Name = name
+	}
+}
+
+// WithObserver sets the Observer which is notified of the decisions, the requests to redis, the errors and the waits.
+func WithObserver(observer ratelimit.Observer) Option {
+	return func(r *GCRALimiter) {
+		r.Observer = observer
+	}
+}
+
+// WithTracer traces Take, Wait and the scripts with tracer, such as the one of the module ratelimit/otel.
+func WithTracer(tracer ratelimit.Tracer) Option {
+	return func(r *GCRALimiter) {
+		r.Tracer = tracer
+	}
+}
+
+// WithPureEval sends the whole script with EVAL every time, for the redis ACLs which block SCRIPT commands.
+func WithPureEval(pureEval bool) Option {
+	return func(r *GCRALimiter) {
+		r.PureEval = pureEval
+	}
+}
+
+// WithFunctions calls the functions of the library loaded by FUNCTION LOAD REPLACE instead of the scripts,
+// Redis 7 is required.
+func WithFunctions(useFunctions bool) Option {
+	return func(r *GCRALimiter) {
+		r.UseFunctions = useFunctions
+	}
+}
+
+// WithBackend runs the scripts with backend instead of the redis client, which may be nil then.
+func WithBackend(backend ratelimit.Backend) Option {
+	return func(r *GCRALimiter) {
+		r.Backend = backend
+	}
+}
+
+// wait until take a token or timeout
+func (r *GCRALimiter) Wait(ctx context.Context) (err error) {
+	return r.WaitN(ctx, 1)
+}
+
+/*
+WaitN waits until take n tokens at once or timeout.
+Redis tells exactly when the tokens are available, so it sleeps until then instead of polling.
+*/
+func (r *GCRALimiter) WaitN(ctx context.Context, n int) (err error) {
+	start := time.Now()
+	ctx, span := r.StartSpan(ctx, "ratelimit.Wait", ratelimit.AttrN.Int(n))
+	defer func() {
+		r.ObserveWait(n, start, err)
+		ratelimit.EndSpan(span, ratelimit.Decision{Allowed: err == nil}, err)
+	}()
+	for {
+		d, err := r.TakeDecision(ctx, n)
+		slog.Debug("r.Take")
+		if err != nil {
+			return err
+		}
+		r.AddPollEvent(ctx, d.Allowed)
+		if d.Allowed {
+			return nil
+		}
+
+		slog.Debug("retryAfter:%v", d.RetryAfter)
+		deadline, ok := ctx.Deadline()
+		if ok {
+			if deadline.Before(time.Now().Add(d.RetryAfter)) {
+				slog.Debug("can't get token before %v", deadline)
+				return fmt.Errorf("%w %v", ratelimit.ErrDeadline, deadline)
+			}
+		}
+
+		timer := time.NewTimer(d.RetryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.New("context timeout")
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *GCRALimiter) Take(ctx context.Context) (bool, error) {
+	return r.TakeN(ctx, 1)
+}
+
+// TakeN takes n tokens at once, either all of them or none.
+// n can't be greater than burst, otherwise ratelimit.ErrExceedsLimit is returned.
+func (r *GCRALimiter) TakeN(ctx context.Context, n int) (bool, error) {
+	d, err := r.TakeDecision(ctx, n)
+	return d.Allowed, err
+}
+
+/*
+TakeDecision works like TakeN, the limit is burst,
+RetryAfter is exactly the time until n tokens are available,
+and ResetAt is the time when the whole burst is available again.
+*/
+func (r *GCRALimiter) TakeDecision(ctx context.Context, n int) (d ratelimit.Decision, err error) {
+	ctx, span := r.StartSpan(ctx, "ratelimit.Take", ratelimit.AttrN.Int(n))
+	defer func() {
+		r.ObserveDecision(n, d, false, err)
+		ratelimit.EndSpan(span, d, err)
+	}()
+	if r.Closed() {
+		return ratelimit.Decision{}, ratelimit.ErrClosed
+	}
+	if n <= 0 {
+		return ratelimit.Decision{}, ratelimit.ErrInvalidN
+	}
+	if n > r.burst {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+
+	// 0. Anti DDoS
+	if r.AntiDDoS {
+		if !r.antiDDoSLimiter.Allow() {
+			return ratelimit.Decision{
+				Allowed:    false,
+				Limit:      r.burst,
+				RetryAfter: r.Interval,
+				Reason:     ratelimit.ReasonLocalShield,
+			}, nil
+		}
+	}
+
+	// 1. try to get from redis
+	start := time.Now()
+	var x interface{}
+	err = r.Fallback.Call(ctx, func() (err error) {
+		x, err = r.EvalScript(
+			ctx,
+			[]string{r.Key},
+			int(r.Interval/time.Microsecond),
+			r.burst,
+			n,
+		).Result()
+		return err
+	})
+	if err != nil {
+		r.ObserveFetch(0, start, false, err)
+		return r.Fallback.Decide(n, r.burst, err)
+	}
+
+	values := x.([]interface{})
+	now := time.Now()
+	d = ratelimit.Decision{
+		Allowed:    values[0].(int64) > 0,
+		Remaining:  int(values[1].(int64)),
+		Limit:      r.burst,
+		RetryAfter: time.Duration(values[2].(int64)) * time.Microsecond,
+		ResetAt:    now.Add(time.Duration(values[3].(int64)) * time.Microsecond),
+	}
+	count := 0
+	if d.Allowed {
+		count = n
+	} else {
+		d.Reason = ratelimit.ReasonQuotaExhausted
+	}
+	r.ObserveFetch(count, start, false, nil)
+	return d, nil
+}
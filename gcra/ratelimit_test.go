@@ -0,0 +1,137 @@
+package gcra
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"log"
+	"testing"
+	"time"
+)
+
+const (
+	key     = "key:gcra"
+	hashVal = "2dc2e815384a2122889fd50398bd4eaf38c3254c"
+)
+
+func MyMatch(expected, actual []interface{}) error {
+	expectedStr := fmt.Sprintf("%v", expected)
+	actualStr := fmt.Sprintf("%v", actual)
+	if expectedStr == actualStr {
+		return nil
+	}
+	log.Printf("expectedStr:%v, actualStr:%v", expectedStr, actualStr)
+	return fmt.Errorf("not equal, expectedStr:%s, actualStr:%s", expectedStr, actualStr)
+}
+
+func TestTakeDecision(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{false})
+	mock.ExpectScriptLoad(ratelimit.AlgMap[ratelimit.GCRAAlg]).SetVal(hashVal)
+	mock.ExpectEvalSha(hashVal, []string{key}, 200000, 3, 2).
+		SetVal([]interface{}{int64(2), int64(1), int64(0), int64(400000)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 200000, 3, 2).
+		SetVal([]interface{}{int64(0), int64(1), int64(150000), int64(350000)})
+
+	limiter, err := NewGCRALimiter(context.Background(), db, key, time.Second,
+		5, 3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+	assert.Equal(t, 3, d.Limit)
+
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 150*time.Millisecond, d.RetryAfter)
+
+	_, err = ratelimit.TakeN(context.Background(), limiter, 4)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+}
+
+func TestWaitRetryAfter(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 200000, 3, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(100000), int64(600000)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 200000, 3, 1).
+		SetVal([]interface{}{int64(1), int64(0), int64(0), int64(600000)})
+
+	limiter, err := NewGCRALimiter(context.Background(), db, key, time.Second,
+		5, 3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	start := time.Now()
+	err = limiter.Wait(context.Background())
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestContextTimeOut(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 200000, 3, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(2000000), int64(2600000)})
+
+	limiter, err := NewGCRALimiter(context.Background(), db, key, time.Second,
+		5, 3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = limiter.Wait(waitCtx)
+	assert.ErrorIs(t, err, ratelimit.ErrDeadline)
+}
+
+func TestAntiDDoSBurst(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 200000, 3, 1).
+		SetVal([]interface{}{int64(1), int64(2), int64(0), int64(200000)})
+
+	limiter, err := NewGCRALimiter(context.Background(), db, key, time.Second, 5, 3,
+		WithAntiDDoSMultiplier(1), WithAntiDDoSBurst(1))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+
+	d, err = taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ratelimit.ReasonLocalShield, d.Reason)
+	assert.Equal(t, "local_shield", d.Reason.String())
+}
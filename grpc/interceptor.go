@@ -0,0 +1,169 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vearne/ratelimit"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+/*
+Interceptor limits the gRPC calls with ratelimit.Limiter.
+On the server side, the denied calls get codes.ResourceExhausted, and if the limiter
+implements ratelimit.DecisionTaker, the status carries errdetails.RetryInfo.
+For streams, every message received by the server takes a permit.
+On the client side, Wait is called before the outbound calls, the calls which can't get a permit
+before the deadline get codes.ResourceExhausted, the canceled ones get the code of the context error,
+and the other errors of the limiter, such as the ones of redis, get codes.Unavailable.
+*/
+type Interceptor struct {
+	// the limiter of the call, nil means the call isn't limited
+	limiterOf func(ctx context.Context, fullMethod string) (ratelimit.Limiter, error)
+}
+
+// NewInterceptor creates an interceptor which limits all the calls with the same limiter.
+func NewInterceptor(limiter ratelimit.Limiter) *Interceptor {
+	return &Interceptor{
+		limiterOf: func(ctx context.Context, fullMethod string) (ratelimit.Limiter, error) {
+			return limiter, nil
+		},
+	}
+}
+
+// NewMethodInterceptor creates an interceptor which limits the calls of every method with its own limiter,
+// the keys of limiters are the full method names, the other methods aren't limited.
+func NewMethodInterceptor(limiters map[string]ratelimit.Limiter) *Interceptor {
+	return &Interceptor{
+		limiterOf: func(ctx context.Context, fullMethod string) (ratelimit.Limiter, error) {
+			return limiters[fullMethod], nil
+		},
+	}
+}
+
+// NewKeyedInterceptor creates an interceptor which limits the calls of every key separately.
+func NewKeyedInterceptor(limiter *ratelimit.KeyedLimiter, keyFunc KeyFunc) *Interceptor {
+	return &Interceptor{
+		limiterOf: func(ctx context.Context, fullMethod string) (ratelimit.Limiter, error) {
+			key, err := keyFunc(ctx, fullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return limiter.Get(key), nil
+		},
+	}
+}
+
+func (i *Interceptor) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		err := i.take(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (i *Interceptor) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		return handler(srv, &limitedServerStream{ServerStream: ss, interceptor: i, fullMethod: info.FullMethod})
+	}
+}
+
+func (i *Interceptor) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := i.wait(ctx, method)
+		if err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func (i *Interceptor) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		err := i.wait(ctx, method)
+		if err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+func (i *Interceptor) take(ctx context.Context, fullMethod string) error {
+	limiter, err := i.limiterOf(ctx, fullMethod)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if limiter == nil {
+		return nil
+	}
+
+	var d ratelimit.Decision
+	if taker, ok := limiter.(ratelimit.DecisionTaker); ok {
+		d, err = taker.TakeDecision(ctx, 1)
+	} else {
+		d.Allowed, err = limiter.Take(ctx)
+	}
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if d.Allowed {
+		return nil
+	}
+
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("%s is rate limited", fullMethod))
+	if d.RetryAfter > 0 {
+		detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(d.RetryAfter)})
+		if err == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+func (i *Interceptor) wait(ctx context.Context, fullMethod string) error {
+	limiter, err := i.limiterOf(clientSide(ctx), fullMethod)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if limiter == nil {
+		return nil
+	}
+
+	err = limiter.Wait(ctx)
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		return status.FromContextError(ctx.Err()).Err()
+	case errors.Is(err, ratelimit.ErrDeadline), errors.Is(err, ratelimit.ErrExceedsLimit):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		// such as the errors of redis
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
+
+type limitedServerStream struct {
+	grpc.ServerStream
+	interceptor *Interceptor
+	fullMethod  string
+}
+
+// RecvMsg takes a permit for every message received, io.EOF at the end of the stream takes none.
+func (s *limitedServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	return s.interceptor.take(s.Context(), s.fullMethod)
+}
@@ -0,0 +1,206 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"github.com/vearne/ratelimit/timewindow"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func dial(t *testing.T, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) grpc_health_v1.HealthClient {
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(serverOpts...)
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	dialOpts = append(dialOpts,
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	conn, err := grpc.NewClient("passthrough:///bufnet", dialOpts...)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return grpc_health_v1.NewHealthClient(conn)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	limiter, err := timewindow.NewSlideTimeWindowLimiter(1, time.Minute, 10)
+	assert.Nil(t, err)
+	interceptor := NewMethodInterceptor(map[string]ratelimit.Limiter{
+		grpc_health_v1.Health_Check_FullMethodName: limiter,
+	})
+	client := dial(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(interceptor.UnaryServerInterceptor()),
+	})
+
+	_, err = client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+
+	_, err = client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Len(t, st.Details(), 1)
+	retryInfo := st.Details()[0].(*errdetails.RetryInfo)
+	assert.True(t, retryInfo.RetryDelay.AsDuration() > 50*time.Second)
+}
+
+func TestKeyedServerInterceptor(t *testing.T) {
+	limiter, err := timewindow.NewKeyedSlideTimeWindowLimiter(1, time.Minute, 10, 100)
+	assert.Nil(t, err)
+	interceptor := NewKeyedInterceptor(limiter, Metadata("tenant"))
+	client := dial(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(interceptor.UnaryServerInterceptor()),
+	})
+
+	check := func(tenant string) codes.Code {
+		ctx := context.Background()
+		if tenant != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "tenant", tenant)
+		}
+		_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		return status.Code(err)
+	}
+	assert.Equal(t, codes.OK, check("a"))
+	assert.Equal(t, codes.OK, check("b"))
+	assert.Equal(t, codes.ResourceExhausted, check("a"))
+	assert.Equal(t, codes.InvalidArgument, check(""))
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	limiter, err := timewindow.NewSlideTimeWindowLimiter(1, time.Minute, 10)
+	assert.Nil(t, err)
+	interceptor := NewInterceptor(limiter)
+	client := dial(t, []grpc.ServerOption{
+		grpc.StreamInterceptor(interceptor.StreamServerInterceptor()),
+	})
+
+	stream, err := client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Nil(t, err)
+
+	// the request message of the second stream is rejected
+	stream, err = client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestClientInterceptor(t *testing.T) {
+	limiter, err := timewindow.NewSlideTimeWindowLimiter(1, time.Minute, 10)
+	assert.Nil(t, err)
+	interceptor := NewInterceptor(limiter)
+	client := dial(t, nil,
+		grpc.WithUnaryInterceptor(interceptor.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(interceptor.StreamClientInterceptor()),
+	)
+
+	_, err = client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestKeyedClientInterceptor(t *testing.T) {
+	limiter, err := timewindow.NewKeyedSlideTimeWindowLimiter(1, time.Minute, 10, 100)
+	assert.Nil(t, err)
+	interceptor := NewKeyedInterceptor(limiter, Metadata("tenant"))
+	client := dial(t, nil, grpc.WithUnaryInterceptor(interceptor.UnaryClientInterceptor()))
+
+	check := func(tenant string) codes.Code {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if tenant != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "tenant", tenant)
+		}
+		_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		return status.Code(err)
+	}
+	assert.Equal(t, codes.OK, check("a"))
+	assert.Equal(t, codes.OK, check("b"))
+	assert.Equal(t, codes.ResourceExhausted, check("a"))
+	assert.Equal(t, codes.InvalidArgument, check(""))
+}
+
+// failingLimiter fails like a limiter whose redis is down
+type failingLimiter struct{}
+
+func (failingLimiter) Take(ctx context.Context) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func (failingLimiter) Wait(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestClientInterceptorErrors(t *testing.T) {
+	client := dial(t, nil,
+		grpc.WithUnaryInterceptor(NewInterceptor(failingLimiter{}).UnaryClientInterceptor()))
+	_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	limiter, err := timewindow.NewSlideTimeWindowLimiter(1, time.Minute, 10)
+	assert.Nil(t, err)
+	client = dial(t, nil, grpc.WithUnaryInterceptor(NewInterceptor(limiter).UnaryClientInterceptor()))
+	_, err = client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+
+	// no deadline, Wait waits until the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
+
+// messageStream receives n messages, then io.EOF
+type messageStream struct {
+	grpc.ServerStream
+	n int
+}
+
+func (s *messageStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *messageStream) RecvMsg(m interface{}) error {
+	if s.n == 0 {
+		return io.EOF
+	}
+	s.n--
+	return nil
+}
+
+func TestRecvMsg(t *testing.T) {
+	limiter, err := timewindow.NewSlideTimeWindowLimiter(2, time.Minute, 10)
+	assert.Nil(t, err)
+	stream := &limitedServerStream{ServerStream: &messageStream{n: 2}, interceptor: NewInterceptor(limiter)}
+	assert.Nil(t, stream.RecvMsg(nil))
+	assert.Nil(t, stream.RecvMsg(nil))
+	// the end of the stream isn't rejected
+	assert.Equal(t, io.EOF, stream.RecvMsg(nil))
+	assert.Equal(t, io.EOF, stream.RecvMsg(nil))
+}
@@ -0,0 +1,47 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/metadata"
+)
+
+var ErrNoKey = errors.New("can't extract the key from the request")
+
+// KeyFunc extracts the key to limit from the call, a custom func can be used as well.
+type KeyFunc func(ctx context.Context, fullMethod string) (string, error)
+
+// clientSideKey marks the context of the calls limited by the client interceptors
+type clientSideKey struct{}
+
+// clientSide tells the key funcs that ctx is the one of an outbound call
+func clientSide(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clientSideKey{}, true)
+}
+
+// FullMethod uses the full method name as the key, such as "/package.Service/Method".
+func FullMethod() KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		return fullMethod, nil
+	}
+}
+
+/*
+Metadata uses the value of the metadata as the key, ErrNoKey is returned if it is empty.
+The server interceptors read the incoming metadata, and the client interceptors read the outgoing one.
+*/
+func Metadata(name string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		var values []string
+		if ctx.Value(clientSideKey{}) != nil {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			values = md.Get(name)
+		} else {
+			values = metadata.ValueFromIncomingContext(ctx, name)
+		}
+		if len(values) == 0 || values[0] == "" {
+			return "", ErrNoKey
+		}
+		return values[0], nil
+	}
+}
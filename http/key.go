@@ -0,0 +1,104 @@
+package http
+
+import (
+	"errors"
+	"net"
+	nethttp "net/http"
+	"net/netip"
+	"strings"
+)
+
+var ErrNoKey = errors.New("can't extract the key from the request")
+
+// KeyFunc extracts the key to limit from the request, a custom func can be used as well.
+type KeyFunc func(r *nethttp.Request) (string, error)
+
+// RemoteIP uses the IP of the peer as the key.
+func RemoteIP() KeyFunc {
+	return func(r *nethttp.Request) (string, error) {
+		return remoteIP(r), nil
+	}
+}
+
+/*
+XForwardedFor uses the IP of the client as the key.
+The addresses in X-Forwarded-For are checked from right to left,
+the first one which isn't a trusted proxy is the client.
+X-Forwarded-For is ignored if the peer isn't a trusted proxy.
+trustedProxies can be IPs or CIDRs, such as "10.0.0.1" and "10.0.0.0/8".
+*/
+func XForwardedFor(trustedProxies ...string) (KeyFunc, error) {
+	prefixes := make([]netip.Prefix, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		} else {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	trusted := func(ip string) bool {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *nethttp.Request) (string, error) {
+		ip := remoteIP(r)
+		if !trusted(ip) {
+			return ip, nil
+		}
+
+		var hops []string
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			if _, err := netip.ParseAddr(hops[i]); err != nil {
+				return "", ErrNoKey
+			}
+			ip = hops[i]
+			if !trusted(ip) {
+				break
+			}
+		}
+		return ip, nil
+	}, nil
+}
+
+// Header uses the value of the header as the key, ErrNoKey is returned if it is empty.
+func Header(name string) KeyFunc {
+	return func(r *nethttp.Request) (string, error) {
+		value := r.Header.Get(name)
+		if value == "" {
+			return "", ErrNoKey
+		}
+		return value, nil
+	}
+}
+
+func remoteIP(r *nethttp.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
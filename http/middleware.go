@@ -0,0 +1,128 @@
+package http
+
+import (
+	"github.com/vearne/ratelimit"
+	slog "github.com/vearne/simplelog"
+	"math"
+	nethttp "net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Middleware limits the requests with ratelimit.Limiter.
+If the limiter implements ratelimit.DecisionTaker, the headers RateLimit-Limit,
+RateLimit-Remaining, RateLimit-Reset and Retry-After are written to the response.
+*/
+type Middleware struct {
+	limiterOf    func(key string) ratelimit.Limiter
+	keyFunc      KeyFunc
+	denyHandler  nethttp.Handler
+	errorHandler func(w nethttp.ResponseWriter, r *nethttp.Request, err error)
+}
+
+type Option func(*Middleware)
+
+// NewMiddleware creates a middleware which limits all the requests with the same limiter.
+func NewMiddleware(limiter ratelimit.Limiter, opts ...Option) *Middleware {
+	return newMiddleware(func(key string) ratelimit.Limiter {
+		return limiter
+	}, func(r *nethttp.Request) (string, error) {
+		return "", nil
+	}, opts...)
+}
+
+// NewKeyedMiddleware creates a middleware which limits the requests of every key separately.
+func NewKeyedMiddleware(limiter *ratelimit.KeyedLimiter, keyFunc KeyFunc, opts ...Option) *Middleware {
+	return newMiddleware(limiter.Get, keyFunc, opts...)
+}
+
+func newMiddleware(limiterOf func(key string) ratelimit.Limiter, keyFunc KeyFunc, opts ...Option) *Middleware {
+	m := Middleware{
+		limiterOf: limiterOf,
+		keyFunc:   keyFunc,
+		denyHandler: nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			nethttp.Error(w, nethttp.StatusText(nethttp.StatusTooManyRequests), nethttp.StatusTooManyRequests)
+		}),
+		errorHandler: func(w nethttp.ResponseWriter, r *nethttp.Request, err error) {
+			slog.Error("ratelimit middleware:%v", err)
+			nethttp.Error(w, nethttp.StatusText(nethttp.StatusInternalServerError), nethttp.StatusInternalServerError)
+		},
+	}
+	// Loop through each option
+	for _, opt := range opts {
+		// Call the option giving the instantiated
+		opt(&m)
+	}
+	return &m
+}
+
+// WithDenyHandler replaces the default response of the denied requests, which is 429 Too Many Requests.
+func WithDenyHandler(h nethttp.Handler) Option {
+	return func(m *Middleware) {
+		m.denyHandler = h
+	}
+}
+
+// WithErrorHandler replaces the default response when the key can't be extracted or the limiter fails,
+// which is 500 Internal Server Error.
+func WithErrorHandler(h func(w nethttp.ResponseWriter, r *nethttp.Request, err error)) Option {
+	return func(m *Middleware) {
+		m.errorHandler = h
+	}
+}
+
+func (m *Middleware) Handler(next nethttp.Handler) nethttp.Handler {
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		key, err := m.keyFunc(r)
+		if err != nil {
+			m.errorHandler(w, r, err)
+			return
+		}
+
+		limiter := m.limiterOf(key)
+		var allowed bool
+		if taker, ok := limiter.(ratelimit.DecisionTaker); ok {
+			var d ratelimit.Decision
+			d, err = taker.TakeDecision(r.Context(), 1)
+			if err == nil {
+				allowed = d.Allowed
+				writeHeaders(w, d)
+			}
+		} else {
+			allowed, err = limiter.Take(r.Context())
+		}
+
+		if err != nil {
+			m.errorHandler(w, r, err)
+			return
+		}
+		if !allowed {
+			m.denyHandler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeHeaders(w nethttp.ResponseWriter, d ratelimit.Decision) {
+	remaining := d.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(time.Until(d.ResetAt))))
+	if !d.Allowed {
+		h.Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+	}
+}
+
+// round up to seconds, the headers don't support the fractional part
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
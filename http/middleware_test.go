@@ -0,0 +1,109 @@
+package http
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit/timewindow"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var okHandler = nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+	w.WriteHeader(nethttp.StatusOK)
+})
+
+func TestMiddleware(t *testing.T) {
+	limiter, err := timewindow.NewSlideTimeWindowLimiter(2, time.Minute, 10)
+	assert.Nil(t, err)
+	handler := NewMiddleware(limiter).Handler(okHandler)
+
+	for i := 1; i >= 0; i-- {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(nethttp.MethodGet, "/", nil))
+		assert.Equal(t, nethttp.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, string(rune('0'+i)), w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "", w.Header().Get("Retry-After"))
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(nethttp.MethodGet, "/", nil))
+	assert.Equal(t, nethttp.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	// the buckets of the window are aligned to 6 seconds
+	for _, header := range []string{"Retry-After", "RateLimit-Reset"} {
+		seconds, err := strconv.Atoi(w.Header().Get(header))
+		assert.Nil(t, err)
+		assert.True(t, seconds > 54 && seconds <= 60)
+	}
+}
+
+func TestKeyedMiddleware(t *testing.T) {
+	limiter, err := timewindow.NewKeyedSlideTimeWindowLimiter(1, time.Minute, 10, 100)
+	assert.Nil(t, err)
+	denied := false
+	handler := NewKeyedMiddleware(limiter, Header("X-User"),
+		WithDenyHandler(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			denied = true
+			w.WriteHeader(nethttp.StatusServiceUnavailable)
+		})),
+	).Handler(okHandler)
+
+	serve := func(user string) int {
+		r := httptest.NewRequest(nethttp.MethodGet, "/", nil)
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, nethttp.StatusOK, serve("a"))
+	assert.Equal(t, nethttp.StatusOK, serve("b"))
+	assert.Equal(t, nethttp.StatusServiceUnavailable, serve("a"))
+	assert.True(t, denied)
+	assert.Equal(t, nethttp.StatusInternalServerError, serve(""))
+}
+
+func TestXForwardedFor(t *testing.T) {
+	keyFunc, err := XForwardedFor("10.0.0.0/8", "192.168.1.1")
+	assert.Nil(t, err)
+
+	cases := []struct {
+		remoteAddr string
+		xff        string
+		key        string
+	}{
+		// the peer isn't trusted
+		{"1.2.3.4:1234", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:1234", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:1234", "5.6.7.8, 192.168.1.1, 10.1.1.1", "5.6.7.8"},
+		// the client can fake the left part
+		{"10.0.0.1:1234", "9.9.9.9, 5.6.7.8, 10.1.1.1", "5.6.7.8"},
+		// all trusted
+		{"10.0.0.1:1234", "10.2.2.2", "10.2.2.2"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(nethttp.MethodGet, "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		key, err := keyFunc(r)
+		assert.Nil(t, err)
+		assert.Equal(t, c.key, key)
+	}
+
+	r := httptest.NewRequest(nethttp.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "unknown")
+	_, err = keyFunc(r)
+	assert.Equal(t, ErrNoKey, err)
+
+	_, err = XForwardedFor("10.0.0.0/33")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,221 @@
+/*
+Package window holds what the sliding log and the sliding window limiters share,
+their scripts take the duration in µs, the throughput and n,
+and return the number of permits taken, the remaining permits, the retry after and the reset in µs.
+*/
+package window
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+	slog "github.com/vearne/simplelog"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+// Limiter allows at most throughput permits in any duration, as the script of Alg estimates.
+type Limiter struct {
+	ratelimit.BaseRateLimiter
+
+	duration   time.Duration
+	throughput int
+
+	/*
+		If the traffic is too large, the limiter will request Redis frequently.
+		To avoid this situation, the frequency of accessing Redis will be limited.
+	*/
+	AntiDDoS        bool
+	antiDDoSLimiter *rate.Limiter
+}
+
+// Options are the settings of the options of the packages which are not fields of Limiter.
+type Options struct {
+	AntiDDoSLimiter    *rate.Limiter
+	AntiDDoSMultiplier float64
+	AntiDDoSBurst      int
+	Degradation        *ratelimit.Degradation
+}
+
+/*
+Prepare checks the arguments and loads the script of alg once, preset is a Limiter with the options applied.
+It returns the function which sets up a Limiter of key after the options are applied to it,
+then limiters of different keys can be created cheaply.
+*/
+func Prepare(ctx context.Context, client redis.Cmdable, alg int, duration time.Duration, throughput int,
+	preset *Limiter, o Options) (func(r *Limiter, key string, o Options), error) {
+
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return nil, err
+	}
+
+	// the keys share the circuit breaker
+	var degradation *ratelimit.Degradation
+	if o.Degradation != nil {
+		d := *o.Degradation
+		if d.Breaker == nil {
+			d.Breaker = ratelimit.NewCircuitBreaker(ratelimit.DefaultFailureThreshold, ratelimit.DefaultCooldown)
+		}
+		degradation = &d
+	}
+	mode, backend := preset.ScriptMode(), preset.Backend
+	scriptSHA1, err := ratelimit.PrepareBackend(ctx, client, backend, alg, degradation, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(r *Limiter, key string, o Options) {
+		r.RedisClient = client
+		r.ScriptSHA1 = scriptSHA1
+		r.Key = key
+		r.Alg = alg
+		r.Interval = duration / time.Duration(throughput)
+		r.duration = duration
+		r.throughput = throughput
+
+		throughputPerSec := ratelimit.PerSecond(throughput, duration)
+		r.antiDDoSLimiter = o.AntiDDoSLimiter
+		if r.AntiDDoS && r.antiDDoSLimiter == nil {
+			r.antiDDoSLimiter = ratelimit.NewAntiDDoSLimiter(throughputPerSec, throughput,
+				o.AntiDDoSMultiplier, o.AntiDDoSBurst)
+		}
+
+		if degradation != nil {
+			probe := ratelimit.BackendProbe(client, backend, mode, alg)
+			r.Fallback = ratelimit.NewFallback(*degradation, throughputPerSec,
+				throughput, probe)
+		}
+	}, nil
+}
+
+// wait until take a token or timeout
+func (r *Limiter) Wait(ctx context.Context) (err error) {
+	return r.WaitN(ctx, 1)
+}
+
+// wait until take n tokens at once or timeout
+func (r *Limiter) WaitN(ctx context.Context, n int) (err error) {
+	start := time.Now()
+	ctx, span := r.StartSpan(ctx, "ratelimit.Wait", ratelimit.AttrN.Int(n))
+	defer func() {
+		r.ObserveWait(n, start, err)
+		ratelimit.EndSpan(span, ratelimit.Decision{Allowed: err == nil}, err)
+	}()
+	ok, err := r.TakeN(ctx, n)
+	slog.Debug("r.Take")
+	if err != nil {
+		return err
+	}
+	r.AddPollEvent(ctx, ok)
+	if ok {
+		return nil
+	}
+
+	deadline, ok := ctx.Deadline()
+	minWaitTime := r.Interval
+	slog.Debug("minWaitTime:%v", minWaitTime)
+	if ok {
+		if deadline.Before(time.Now().Add(minWaitTime)) {
+			slog.Debug("can't get token before %v", deadline)
+			return fmt.Errorf("%w %v", ratelimit.ErrDeadline, deadline)
+		}
+	}
+
+	for {
+		timer := time.NewTimer(minWaitTime)
+		select {
+		// 执行的代码
+		case <-ctx.Done():
+			return errors.New("context timeout")
+		case <-timer.C:
+			ok, err := r.TakeN(ctx, n)
+			if err != nil {
+				return err
+			}
+			r.AddPollEvent(ctx, ok)
+			if ok {
+				return nil
+			}
+		}
+	}
+}
+
+func (r *Limiter) Take(ctx context.Context) (bool, error) {
+	return r.TakeN(ctx, 1)
+}
+
+// TakeN takes n tokens at once, either all of them or none.
+// n can't be greater than throughput, otherwise ratelimit.ErrExceedsLimit is returned.
+func (r *Limiter) TakeN(ctx context.Context, n int) (bool, error) {
+	d, err := r.TakeDecision(ctx, n)
+	return d.Allowed, err
+}
+
+// TakeDecision works like TakeN, ResetAt is the time when the permits taken so far stop counting.
+func (r *Limiter) TakeDecision(ctx context.Context, n int) (d ratelimit.Decision, err error) {
+	ctx, span := r.StartSpan(ctx, "ratelimit.Take", ratelimit.AttrN.Int(n))
+	defer func() {
+		r.ObserveDecision(n, d, false, err)
+		ratelimit.EndSpan(span, d, err)
+	}()
+	if r.Closed() {
+		return ratelimit.Decision{}, ratelimit.ErrClosed
+	}
+	if n <= 0 {
+		return ratelimit.Decision{}, ratelimit.ErrInvalidN
+	}
+	if n > r.throughput {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+
+	// 0. Anti DDoS
+	if r.AntiDDoS {
+		if !r.antiDDoSLimiter.Allow() {
+			return ratelimit.Decision{
+				Allowed:    false,
+				Limit:      r.throughput,
+				RetryAfter: r.Interval,
+				Reason:     ratelimit.ReasonLocalShield,
+			}, nil
+		}
+	}
+
+	// 1. try to get from redis
+	start := time.Now()
+	var x interface{}
+	err = r.Fallback.Call(ctx, func() (err error) {
+		x, err = r.EvalScript(
+			ctx,
+			[]string{r.Key},
+			int(r.duration/time.Microsecond),
+			r.throughput,
+			n,
+		).Result()
+		return err
+	})
+	if err != nil {
+		r.ObserveFetch(0, start, false, err)
+		return r.Fallback.Decide(n, r.throughput, err)
+	}
+
+	values := x.([]interface{})
+	now := time.Now()
+	d = ratelimit.Decision{
+		Allowed:    values[0].(int64) > 0,
+		Remaining:  int(values[1].(int64)),
+		Limit:      r.throughput,
+		RetryAfter: time.Duration(values[2].(int64)) * time.Microsecond,
+		ResetAt:    now.Add(time.Duration(values[3].(int64)) * time.Microsecond),
+	}
+	count := 0
+	if d.Allowed {
+		count = n
+	} else {
+		d.Reason = ratelimit.ReasonQuotaExhausted
+	}
+	r.ObserveFetch(count, start, false, nil)
+	return d, nil
+}
@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	slog "github.com/vearne/simplelog"
+	"sync"
+)
+
+/*
+KeyedLimiter limits every key separately with the same configuration.
+The limiters of the keys are created on demand, they share the redis client and the script,
+and at most size of them are kept in memory, the least recently used ones are evicted.
+An evicted limiter is not closed, because the callers may still use it,
+only the permits cached locally by it are given back.
+*/
+type KeyedLimiter struct {
+	sync.Mutex
+	size       int
+	newLimiter func(key string) Limiter
+	ll         *list.List
+	items      map[string]*list.Element
+	closed     bool
+}
+
+type keyedEntry struct {
+	key     string
+	limiter Limiter
+}
+
+// NewKeyedLimiter creates a KeyedLimiter which keeps at most size limiters created by newLimiter.
+func NewKeyedLimiter(size int, newLimiter func(key string) Limiter) (*KeyedLimiter, error) {
+	if size <= 0 {
+		return nil, errors.New("size must greater than 0")
+	}
+	return &KeyedLimiter{
+		size:       size,
+		newLimiter: newLimiter,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}, nil
+}
+
+// Get returns the limiter of key, it is created if not exists.
+func (k *KeyedLimiter) Get(key string) Limiter {
+	limiter, evicted := k.get(key)
+	for _, l := range evicted {
+		// the evicted limiters give the permits cached locally back to redis, don't hold the lock
+		go flushEvicted(l)
+	}
+	return limiter
+}
+
+func (k *KeyedLimiter) get(key string) (Limiter, []Limiter) {
+	k.Lock()
+	defer k.Unlock()
+
+	if e, ok := k.items[key]; ok {
+		k.ll.MoveToFront(e)
+		return e.Value.(*keyedEntry).limiter, nil
+	}
+
+	limiter := k.newLimiter(key)
+	if k.closed {
+		// the limiter is not kept, it is closed like the others
+		_ = Close(context.Background(), limiter)
+		return limiter, nil
+	}
+	k.items[key] = k.ll.PushFront(&keyedEntry{key: key, limiter: limiter})
+	var evicted []Limiter
+	for k.ll.Len() > k.size {
+		e := k.ll.Back()
+		k.ll.Remove(e)
+		delete(k.items, e.Value.(*keyedEntry).key)
+		evicted = append(evicted, e.Value.(*keyedEntry).limiter)
+	}
+	return limiter, evicted
+}
+
+func flushEvicted(limiter Limiter) {
+	f, ok := limiter.(Flusher)
+	if !ok {
+		return
+	}
+	err := f.Flush(context.Background())
+	if err != nil {
+		slog.Error("flush the evicted limiter:%v", err)
+	}
+}
+
+/*
+Close closes all the limiters kept in memory, the errors of them are joined.
+The limiters of all the keys return ErrClosed after it, except the evicted ones which are still used by the callers.
+*/
+func (k *KeyedLimiter) Close(ctx context.Context) error {
+	k.Lock()
+	k.closed = true
+	limiters := make([]Limiter, 0, k.ll.Len())
+	for e := k.ll.Front(); e != nil; e = e.Next() {
+		limiters = append(limiters, e.Value.(*keyedEntry).limiter)
+	}
+	k.ll.Init()
+	k.items = make(map[string]*list.Element)
+	k.Unlock()
+
+	var errs []error
+	for _, limiter := range limiters {
+		errs = append(errs, Close(ctx, limiter))
+	}
+	return errors.Join(errs...)
+}
+
+// Len returns the number of keys kept in memory.
+func (k *KeyedLimiter) Len() int {
+	k.Lock()
+	defer k.Unlock()
+	return k.ll.Len()
+}
+
+func (k *KeyedLimiter) Take(ctx context.Context, key string) (bool, error) {
+	return k.Get(key).Take(ctx)
+}
+
+func (k *KeyedLimiter) Wait(ctx context.Context, key string) error {
+	return k.Get(key).Wait(ctx)
+}
+
+func (k *KeyedLimiter) TakeN(ctx context.Context, key string, n int) (bool, error) {
+	return TakeN(ctx, k.Get(key), n)
+}
+
+func (k *KeyedLimiter) WaitN(ctx context.Context, key string, n int) error {
+	return WaitN(ctx, k.Get(key), n)
+}
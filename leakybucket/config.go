@@ -0,0 +1,32 @@
+package leakybucket
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+)
+
+func init() {
+	ratelimit.Register("leaky_bucket", newFromConfig)
+}
+
+// newFromConfig creates the limiter of ratelimit.New, a token leaks out every Rate.Per / Rate.Count.
+func newFromConfig(ctx context.Context, client redis.Cmdable, cfg ratelimit.Config,
+	rate ratelimit.Rate) (ratelimit.Limiter, error) {
+	if cfg.Burst != 0 {
+		return nil, ratelimit.NewConfigError("burst", "it is not supported by leaky_bucket")
+	}
+	if cfg.Batch != 0 {
+		return nil, ratelimit.NewConfigError("batch", "it is not supported by leaky_bucket")
+	}
+	if cfg.Buckets != 0 {
+		return nil, ratelimit.NewConfigError("buckets", "it is not supported by leaky_bucket")
+	}
+	if cfg.Local {
+		return NewLocal(rate.Per, rate.Count, WithName(cfg.Name))
+	}
+	if cfg.Key == "" {
+		return nil, ratelimit.NewConfigError("key", "it is required by leaky_bucket")
+	}
+	return NewLeakyBucketLimiter(ctx, client, cfg.Key, rate.Per, rate.Count, WithName(cfg.Name))
+}
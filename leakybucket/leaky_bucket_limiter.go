@@ -2,7 +2,6 @@ package leakybucket
 
 import (
 	"context"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
@@ -16,14 +15,21 @@ type LeakyBucketLimiter struct {
 	ratelimit.BaseRateLimiter
 
 	// For interval between requests,the smallest unit of duration is one microseconds.
-	interval time.Duration
+	interval   time.Duration
+	throughput int
 
 	/*
 		If the traffic is too large, the limiter will request Redis frequently.
 		To avoid this situation, the frequency of accessing Redis will be limited.
 	*/
-	AntiDDoS        bool
-	antiDDoSLimiter *rate.Limiter
+	AntiDDoS           bool
+	antiDDoSLimiter    *rate.Limiter
+	antiDDoSMultiplier float64
+	antiDDoSBurst      int
+	// the anti-DDoS limiter is created by the limiter rather than WithAntiDDoSLimiter, SetLimit changes it
+	ownAntiDDoS bool
+
+	degradation *ratelimit.Degradation
 }
 
 type Option func(*LeakyBucketLimiter)
@@ -31,77 +37,216 @@ type Option func(*LeakyBucketLimiter)
 func NewLeakyBucketLimiter(ctx context.Context, client redis.Cmdable, key string, duration time.Duration,
 	throughput int, opts ...Option) (ratelimit.Limiter, error) {
 
-	_, err := client.Ping(ctx).Result()
+	newLimiter, err := prepare(ctx, client, duration, throughput, opts...)
 	if err != nil {
 		return nil, err
 	}
+	return newLimiter(key), nil
+}
 
-	if duration < time.Millisecond {
-		return nil, errors.New("duration is too small")
+/*
+NewKeyedLeakyBucketLimiter creates a limiter which limits every key separately,
+the key in redis is keyPrefix + key, and at most maxKeys limiters are kept in memory.
+*/
+func NewKeyedLeakyBucketLimiter(ctx context.Context, client redis.Cmdable, keyPrefix string,
+	duration time.Duration, throughput int,
+	maxKeys int, opts ...Option) (*ratelimit.KeyedLimiter, error) {
+
+	if maxKeys <= 0 {
+		return nil, errors.New("maxKeys must greater than 0")
 	}
 
-	if throughput <= 0 {
-		return nil, errors.New("throughput must greater than 0")
+	newLimiter, err := prepare(ctx, client, duration, throughput, opts...)
+	if err != nil {
+		return nil, err
 	}
+	return ratelimit.NewKeyedLimiter(maxKeys, func(key string) ratelimit.Limiter {
+		return newLimiter(keyPrefix + key)
+	})
+}
+
+// check the arguments and load the script once, then limiters of different keys can be created cheaply
+func prepare(ctx context.Context, client redis.Cmdable, duration time.Duration,
+	throughput int, opts ...Option) (func(key string) *LeakyBucketLimiter, error) {
 
-	script := ratelimit.AlgMap[ratelimit.LeakyBucketAlg]
-	scriptSHA1 := fmt.Sprintf("%x", sha1.Sum([]byte(script)))
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return nil, err
+	}
 
-	r := LeakyBucketLimiter{
-		BaseRateLimiter: ratelimit.BaseRateLimiter{RedisClient: client, ScriptSHA1: scriptSHA1, Key: key},
-		interval:        duration / time.Duration(throughput),
-		AntiDDoS:        true,
+	degradation, mode, backend := presetOf(opts)
+	scriptSHA1, err := ratelimit.PrepareBackend(ctx, client, backend, ratelimit.LeakyBucketAlg, degradation, mode)
+	if err != nil {
+		return nil, err
 	}
 
-	// Loop through each option
+	return func(key string) *LeakyBucketLimiter {
+		r := LeakyBucketLimiter{
+			BaseRateLimiter: ratelimit.BaseRateLimiter{RedisClient: client, ScriptSHA1: scriptSHA1, Key: key},
+			interval:        duration / time.Duration(throughput),
+			throughput:      throughput,
+			AntiDDoS:        true,
+		}
+		r.Alg = ratelimit.LeakyBucketAlg
+
+		// Loop through each option
+		for _, opt := range opts {
+			// Call the option giving the instantiated
+			opt(&r)
+		}
+
+		throughputPerSec := ratelimit.PerSecond(throughput, duration)
+		if r.AntiDDoS && r.antiDDoSLimiter == nil {
+			r.antiDDoSLimiter = ratelimit.NewAntiDDoSLimiter(throughputPerSec, throughput,
+				r.antiDDoSMultiplier, r.antiDDoSBurst)
+			r.ownAntiDDoS = true
+		}
+
+		if degradation != nil {
+			probe := ratelimit.BackendProbe(client, backend, mode, ratelimit.LeakyBucketAlg)
+			r.Fallback = ratelimit.NewFallback(*degradation, throughputPerSec,
+				throughput, probe)
+		}
+		return &r
+	}, nil
+}
+
+// the options which are needed before the limiters are created, the keys share the circuit breaker
+func presetOf(opts []Option) (*ratelimit.Degradation, ratelimit.ScriptMode, ratelimit.Backend) {
+	var r LeakyBucketLimiter
 	for _, opt := range opts {
-		// Call the option giving the instantiated
 		opt(&r)
 	}
+	if r.degradation == nil {
+		return nil, r.ScriptMode(), r.Backend
+	}
+	d := *r.degradation
+	if d.Breaker == nil {
+		d.Breaker = ratelimit.NewCircuitBreaker(ratelimit.DefaultFailureThreshold, ratelimit.DefaultCooldown)
+	}
+	return &d, r.ScriptMode(), r.Backend
+}
 
-	values, err := r.RedisClient.ScriptExists(ctx, r.ScriptSHA1).Result()
-	if err != nil {
-		return nil, err
+func WithAntiDDos(antiDDoS bool) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.AntiDDoS = antiDDoS
 	}
-	if !values[0] {
-		_, err = r.RedisClient.ScriptLoad(ctx, script).Result()
-		if err != nil {
-			return nil, err
-		}
+}
+
+// WithAntiDDoSMultiplier sets how many times the throughput the local anti-DDoS limiter allows, 2 by default.
+func WithAntiDDoSMultiplier(multiplier float64) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.antiDDoSMultiplier = multiplier
 	}
+}
 
-	throughputPerSec := int(float64(throughput) / float64(duration/time.Second))
-	if r.AntiDDoS {
-		r.antiDDoSLimiter = rate.NewLimiter(rate.Limit(throughputPerSec*2), throughputPerSec*2)
+// WithAntiDDoSBurst sets how many requests the local anti-DDoS limiter allows at once.
+func WithAntiDDoSBurst(burst int) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.antiDDoSBurst = burst
 	}
+}
 
-	return &r, nil
+// WithAntiDDoSLimiter replaces the local anti-DDoS limiter, it is shared by all the keys of a keyed limiter.
+func WithAntiDDoSLimiter(limiter *rate.Limiter) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.AntiDDoS = true
+		r.antiDDoSLimiter = limiter
+	}
 }
 
-func WithAntiDDos(antiDDoS bool) Option {
+// WithDegradation decides what to do when redis is unavailable, the errors are returned by default.
+func WithDegradation(d ratelimit.Degradation) Option {
 	return func(r *LeakyBucketLimiter) {
-		r.AntiDDoS = antiDDoS
+		r.degradation = &d
+	}
+}
+
+// WithName sets the name of the limiter which is given to the Observer.
+func WithName(name string) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.Name = name
+	}
+}
+
+// WithObserver sets the Observer which is notified of the decisions, the requests to redis, the errors and the waits.
+func WithObserver(observer ratelimit.Observer) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.Observer = observer
+	}
+}
+
+// WithTracer traces Take, Wait and the scripts with tracer, such as the one of the module ratelimit/otel.
+func WithTracer(tracer ratelimit.Tracer) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.Tracer = tracer
+	}
+}
+
+/*
+WithOverrides makes the scripts read the limit of the key from the hash hashKey of ratelimit.Overrides,
+the limit given to the constructor is used if the key has none.
+n is checked against the throughput of the key, which Decision.Limit reports,
+but the local checks, such as the anti-DDoS limiter, still use the limit given to the constructor.
+*/
+func WithOverrides(hashKey string) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.OverridesKey = hashKey
+	}
+}
+
+// WithPureEval sends the whole script with EVAL every time, for the redis ACLs which block SCRIPT commands.
+func WithPureEval(pureEval bool) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.PureEval = pureEval
+	}
+}
+
+// WithFunctions calls the functions of the library loaded by FUNCTION LOAD REPLACE instead of the scripts,
+// Redis 7 is required.
+func WithFunctions(useFunctions bool) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.UseFunctions = useFunctions
+	}
+}
+
+// WithBackend runs the scripts with backend instead of the redis client, which may be nil then.
+func WithBackend(backend ratelimit.Backend) Option {
+	return func(r *LeakyBucketLimiter) {
+		r.Backend = backend
 	}
 }
 
 // wait until take a token or timeout
 func (r *LeakyBucketLimiter) Wait(ctx context.Context) (err error) {
-	ok, err := r.Take(ctx)
+	return r.WaitN(ctx, 1)
+}
+
+// wait until take n tokens at once or timeout
+func (r *LeakyBucketLimiter) WaitN(ctx context.Context, n int) (err error) {
+	start := time.Now()
+	ctx, span := r.StartSpan(ctx, "ratelimit.Wait", ratelimit.AttrN.Int(n))
+	defer func() {
+		r.ObserveWait(n, start, err)
+		ratelimit.EndSpan(span, ratelimit.Decision{Allowed: err == nil}, err)
+	}()
+	ok, err := r.TakeN(ctx, n)
 	slog.Debug("r.Take")
 	if err != nil {
 		return err
 	}
+	r.AddPollEvent(ctx, ok)
 	if ok {
 		return nil
 	}
 
 	deadline, ok := ctx.Deadline()
-	minWaitTime := r.interval
+	minWaitTime, _ := r.limits()
 	slog.Debug("minWaitTime:%v", minWaitTime)
 	if ok {
 		if deadline.Before(time.Now().Add(minWaitTime)) {
 			slog.Debug("can't get token before %v", deadline)
-			return fmt.Errorf("can't get token before %v", deadline)
+			return fmt.Errorf("%w %v", ratelimit.ErrDeadline, deadline)
 		}
 	}
 
@@ -113,10 +258,11 @@ func (r *LeakyBucketLimiter) Wait(ctx context.Context) (err error) {
 		case <-ctx.Done():
 			return errors.New("context timeout")
 		case <-timer.C:
-			ok, err := r.Take(ctx)
+			ok, err := r.TakeN(ctx, n)
 			if err != nil {
 				return err
 			}
+			r.AddPollEvent(ctx, ok)
 			if ok {
 				return nil
 			}
@@ -125,30 +271,190 @@ func (r *LeakyBucketLimiter) Wait(ctx context.Context) (err error) {
 }
 
 func (r *LeakyBucketLimiter) Take(ctx context.Context) (bool, error) {
+	return r.TakeN(ctx, 1)
+}
+
+/*
+TakeN takes n tokens at once, either all of them or none.
+The n tokens leak out of the bucket one interval after another,
+so the following requests have to wait for n intervals.
+n can't be greater than throughput, otherwise ratelimit.ErrExceedsLimit is returned.
+*/
+func (r *LeakyBucketLimiter) TakeN(ctx context.Context, n int) (bool, error) {
+	d, err := r.TakeDecision(ctx, n)
+	return d.Allowed, err
+}
+
+/*
+TakeDecision works like TakeN.
+The limit is throughput, the tokens in the bucket take up a part of it until they leak out,
+one per interval, the rest is remaining. ResetAt is the time when the bucket is empty.
+*/
+func (r *LeakyBucketLimiter) TakeDecision(ctx context.Context, n int) (d ratelimit.Decision, err error) {
+	ctx, span := r.StartSpan(ctx, "ratelimit.Take", ratelimit.AttrN.Int(n))
+	defer func() {
+		r.ObserveDecision(n, d, false, err)
+		ratelimit.EndSpan(span, d, err)
+	}()
+	if r.Closed() {
+		return ratelimit.Decision{}, ratelimit.ErrClosed
+	}
+	if n <= 0 {
+		return ratelimit.Decision{}, ratelimit.ErrInvalidN
+	}
+	interval, throughput := r.limits()
+	// the throughput of the key may be overridden, then only the script knows it
+	if n > throughput && r.OverridesKey == "" {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+
 	// 0. Anti DDoS
 	if r.AntiDDoS {
 		if !r.antiDDoSLimiter.Allow() {
-			return false, nil
+			return ratelimit.Decision{
+				Allowed:    false,
+				Limit:      throughput,
+				ResetAt:    time.Now().Add(interval),
+				RetryAfter: interval,
+				Reason:     ratelimit.ReasonLocalShield,
+			}, nil
 		}
 	}
 
 	// 1. try to get from redis
-	x, err := r.RedisClient.EvalSha(
-		ctx,
-		r.ScriptSHA1,
-		[]string{r.Key},
-		int(r.interval/time.Microsecond),
-	).Result()
+	start := time.Now()
+	var x interface{}
+	err = r.Fallback.Call(ctx, func() (err error) {
+		x, err = r.EvalScript(
+			ctx,
+			r.OverrideKeys(),
+			int(interval/time.Microsecond),
+			throughput,
+			n,
+		).Result()
+		return err
+	})
+	if err != nil {
+		r.ObserveFetch(0, start, false, err)
+		return r.Fallback.Decide(n, throughput, err)
+	}
 
+	values := x.([]interface{})
+	count := values[0].(int64)
+	wait := time.Duration(values[1].(int64)) * time.Microsecond
+	// the limit of the key
+	throughput = int(values[2].(int64))
+	interval = time.Duration(values[3].(int64)) * time.Microsecond
+	r.ObserveFetch(int(count), start, false, nil)
+	if n > throughput {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+
+	d = ratelimit.Decision{
+		Allowed:   count > 0,
+		Remaining: remaining(throughput, interval, wait),
+		Limit:     throughput,
+		ResetAt:   time.Now().Add(wait),
+	}
+	if !d.Allowed {
+		d.RetryAfter = wait
+		d.Reason = ratelimit.ReasonQuotaExhausted
+	}
+	return d, nil
+}
+
+// remaining returns the part of throughput not taken up by the tokens which leak out of the bucket in wait
+func remaining(throughput int, interval time.Duration, wait time.Duration) int {
+	if wait <= 0 {
+		return throughput
+	}
+	tokens := int((wait + interval - 1) / interval)
+	return max(throughput-tokens, 0)
+}
+
+/*
+Reserve reserves n tokens, they leak out of the bucket when the previous ones are gone,
+redis computes how long it takes.
+The reservation is not OK if n is greater than the throughput,
+which is the one given to the constructor unless WithOverrides gives the key another one.
+*/
+func (r *LeakyBucketLimiter) Reserve(ctx context.Context, n int) (*ratelimit.Reservation, error) {
+	if r.Closed() {
+		return nil, ratelimit.ErrClosed
+	}
+	if n <= 0 {
+		return nil, ratelimit.ErrInvalidN
+	}
+	interval, throughput := r.limits()
+	if n > throughput && r.OverridesKey == "" {
+		return ratelimit.NewReservation(false, 0, nil), nil
+	}
+
+	// 0. Anti DDoS
+	if r.AntiDDoS {
+		if !r.antiDDoSLimiter.Allow() {
+			return ratelimit.NewReservation(false, 0, nil), nil
+		}
+	}
+
+	// 1. try to reserve in redis
+	var x interface{}
+	err := r.Fallback.Call(ctx, func() (err error) {
+		x, err = r.RunScript(
+			ctx,
+			ratelimit.LeakyBucketReserveAlg,
+			r.OverrideKeys(),
+			int(interval/time.Microsecond),
+			throughput,
+			n,
+		).Result()
+		return err
+	})
 	if err != nil {
-		return false, err
+		return r.Fallback.Reserve(n, err)
 	}
 
-	count := x.(int64)
+	values := x.([]interface{})
+	delay := values[0].(int64)
+	if delay < 0 {
+		return ratelimit.NewReservation(false, 0, nil), nil
+	}
+	updateTime := values[1].(int64)
+	lastUpdateTime := values[2].(int64)
+	return ratelimit.NewReservation(true, time.Duration(delay)*time.Microsecond,
+		func(ctx context.Context) error {
+			return r.Fallback.Call(ctx, func() error {
+				return r.RunScript(ctx, ratelimit.LeakyBucketCancelAlg, []string{r.Key},
+					updateTime, lastUpdateTime).Err()
+			})
+		}), nil
+}
+
+// the settings which can be changed by SetLimit
+func (r *LeakyBucketLimiter) limits() (time.Duration, int) {
+	r.Lock()
+	defer r.Unlock()
+	return r.interval, r.throughput
+}
 
-	if count <= 0 {
-		return false, nil
-	} else {
-		return true, nil
+/*
+SetLimit changes the rate to throughput tokens per duration while the limiter is used,
+the anti-DDoS limiter and the in-process fallback follow it.
+*/
+func (r *LeakyBucketLimiter) SetLimit(duration time.Duration, throughput int) error {
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.interval = duration / time.Duration(throughput)
+	r.throughput = throughput
+	throughputPerSec := ratelimit.PerSecond(throughput, duration)
+	if r.ownAntiDDoS {
+		ratelimit.ResetAntiDDoSLimiter(r.antiDDoSLimiter, throughputPerSec, throughput,
+			r.antiDDoSMultiplier, r.antiDDoSBurst)
 	}
+	r.Fallback.SetLimit(throughputPerSec, throughput)
+	return nil
 }
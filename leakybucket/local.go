@@ -0,0 +1,22 @@
+package leakybucket
+
+import (
+	"context"
+	"github.com/vearne/ratelimit"
+	"time"
+)
+
+// localKey is the key of the local limiters, every one of them has a MemoryBackend of its own
+const localKey = "local"
+
+/*
+NewLocal creates a LeakyBucketLimiter which works in memory, for a single process,
+it lets throughput tokens leak out in every duration.
+It runs the script on a ratelimit.MemoryBackend of its own, without the anti-DDoS limiter.
+opts such as WithName and WithObserver work the same as with redis, WithBackend is ignored.
+*/
+func NewLocal(duration time.Duration, throughput int, opts ...Option) (ratelimit.Limiter, error) {
+	opts = append([]Option{WithAntiDDos(false)}, opts...)
+	opts = append(opts, WithBackend(ratelimit.NewMemoryBackend()))
+	return NewLeakyBucketLimiter(context.Background(), nil, localKey, duration, throughput, opts...)
+}
@@ -2,9 +2,13 @@ package leakybucket
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
 	"log"
 	"testing"
 	"time"
@@ -12,7 +16,7 @@ import (
 
 const (
 	key     = "key:leaky"
-	hashVal = "4696404e6e98f6007cacbe256edbccc6a4adaeb3"
+	hashVal = "d067f8aea81715dc5e019675511f6dd9a180b187"
 )
 
 func MyMatch(expected, actual []interface{}) error {
@@ -32,7 +36,8 @@ func TestTakeFail(t *testing.T) {
 	mock.ExpectPing().SetVal("PONG")
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
-	mock.ExpectEvalSha(hashVal, []string{key}, 333333).SetVal(int64(0))
+	mock.ExpectEvalSha(hashVal, []string{key}, 333333, 3, 1).
+		SetVal([]interface{}{int64(0), int64(100000), int64(3), int64(333333)})
 
 	limiter, err := NewLeakyBucketLimiter(context.Background(), db, key, time.Second,
 		3, WithAntiDDos(false))
@@ -58,7 +63,8 @@ func TestTakeSuccess(t *testing.T) {
 	mock.ExpectPing().SetVal("PONG")
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
-	mock.ExpectEvalSha(hashVal, []string{key}, 333333).SetVal(int64(1))
+	mock.ExpectEvalSha(hashVal, []string{key}, 333333, 3, 1).
+		SetVal([]interface{}{int64(1), int64(333333), int64(3), int64(333333)})
 
 	limiter, err := NewLeakyBucketLimiter(context.Background(), db, key,
 		time.Second,
@@ -85,7 +91,8 @@ func TestContextTimeOut(t *testing.T) {
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true, true})
 	for i := 0; i < 1000; i++ {
-		mock.ExpectEvalSha(hashVal, []string{key}, 333333).SetVal(int64(0))
+		mock.ExpectEvalSha(hashVal, []string{key}, 333333, 3, 1).
+			SetVal([]interface{}{int64(0), int64(100000), int64(3), int64(333333)})
 	}
 
 	limiter, err := NewLeakyBucketLimiter(context.Background(), db, key,
@@ -101,3 +108,218 @@ func TestContextTimeOut(t *testing.T) {
 	err = limiter.Wait(waitCtx)
 	assert.Contains(t, err.Error(), "timeout")
 }
+
+func TestTakeN(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 333333, 3, 2).
+		SetVal([]interface{}{int64(2), int64(666666), int64(3), int64(333333)})
+
+	limiter, err := NewLeakyBucketLimiter(context.Background(), db, key,
+		time.Second,
+		3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = ratelimit.TakeN(context.Background(), limiter, 0)
+	assert.Equal(t, ratelimit.ErrInvalidN, err)
+	_, err = ratelimit.TakeN(context.Background(), limiter, 4)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+}
+
+func TestReserve(t *testing.T) {
+	reserveHashVal := "fdc477893e0d2e8a766880e0ab3f3deac48c72be"
+	cancelHashVal := "e3ebb465aacdb84a620635b2cd4909ea37951a0a"
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(reserveHashVal, []string{key}, 333333, 3, 2).
+		SetVal([]interface{}{int64(333333), int64(1700000000666666), int64(1700000000000000)})
+	mock.ExpectEvalSha(cancelHashVal, []string{key}, 1700000000666666, 1700000000000000).SetVal(int64(1))
+
+	limiter, err := NewLeakyBucketLimiter(context.Background(), db, key,
+		time.Second,
+		3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	reserver := limiter.(ratelimit.Reserver)
+
+	r, err := reserver.Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.True(t, r.Delay() > 300*time.Millisecond && r.Delay() <= 333333*time.Microsecond)
+	r.Cancel()
+}
+
+func TestTakeDecision(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 333333, 3, 1).
+		SetVal([]interface{}{int64(0), int64(200000), int64(3), int64(333333)})
+
+	limiter, err := NewLeakyBucketLimiter(context.Background(), db, key,
+		time.Second,
+		3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	// the token which leaks out in 200ms takes up 1 of 3
+	assert.Equal(t, 2, d.Remaining)
+	assert.Equal(t, 3, d.Limit)
+	assert.Equal(t, 200*time.Millisecond, d.RetryAfter)
+}
+
+func TestDurations(t *testing.T) {
+	cases := []struct {
+		duration   time.Duration
+		throughput int
+		interval   int
+	}{
+		// 50 per 250ms
+		{250 * time.Millisecond, 50, 5000},
+		// 90 per 1.5s
+		{1500 * time.Millisecond, 90, 16666},
+		{time.Millisecond, 1, 1000},
+		{time.Hour, 3600, 1000000},
+	}
+	for _, c := range cases {
+		db, mock := redismock.NewClientMock()
+
+		mock = mock.CustomMatch(MyMatch)
+		mock.ExpectPing().SetVal("PONG")
+		mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+		mock.ExpectEvalSha(hashVal, []string{key}, c.interval, c.throughput, 1).
+			SetVal([]interface{}{int64(1), int64(c.interval), int64(c.throughput), int64(c.interval)})
+
+		// the anti DDoS limiter works with any duration
+		limiter, err := NewLeakyBucketLimiter(context.Background(), db, key, c.duration,
+			c.throughput)
+		if err != nil {
+			t.Errorf("unexpected error, %v", err)
+			return
+		}
+
+		ok, err := limiter.Take(context.Background())
+		assert.Nil(t, err, c.duration)
+		assert.True(t, ok, c.duration)
+	}
+
+	_, err := NewLeakyBucketLimiter(context.Background(), nil, key, time.Millisecond, 2000)
+	assert.NotNil(t, err)
+}
+
+func TestLocal(t *testing.T) {
+	limiter, err := NewLocal(time.Second, 10)
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	// 2 tokens drain the bucket for 2 intervals
+	d, err := taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 8, d.Remaining)
+	assert.Equal(t, 10, d.Limit)
+
+	d, err = taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ratelimit.ReasonQuotaExhausted, d.Reason)
+	assert.InDelta(t, float64(200*time.Millisecond), float64(d.RetryAfter), float64(10*time.Millisecond))
+
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.InDelta(t, float64(200*time.Millisecond), float64(r.Delay()), float64(10*time.Millisecond))
+	r.Cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.Nil(t, limiter.Wait(ctx))
+	assert.InDelta(t, float64(200*time.Millisecond), float64(time.Since(start)), float64(50*time.Millisecond))
+
+	assert.Nil(t, ratelimit.Close(context.Background(), limiter))
+	_, err = limiter.Take(context.Background())
+	assert.Equal(t, ratelimit.ErrClosed, err)
+}
+
+// TestOverridesLimit gives the key a larger limit than the one of the constructor.
+func TestOverridesLimit(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	overrides := ratelimit.NewOverrides(client, ratelimit.DefaultOverridesKey)
+	err := overrides.Set(context.Background(), key, ratelimit.Override{Duration: time.Second, Throughput: 10})
+	assert.Nil(t, err)
+	limiter, err := NewLeakyBucketLimiter(context.Background(), client, key, time.Second, 2,
+		WithAntiDDos(false), WithOverrides(ratelimit.DefaultOverridesKey))
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 5)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 10, d.Limit)
+	_, err = taker.TakeDecision(context.Background(), 11)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	r, err = limiter.(ratelimit.Reserver).Reserve(context.Background(), 11)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+}
+
+func TestCancelBreaker(t *testing.T) {
+	reserveHashVal := "fdc477893e0d2e8a766880e0ab3f3deac48c72be"
+	cancelHashVal := "e3ebb465aacdb84a620635b2cd4909ea37951a0a"
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(reserveHashVal, []string{key}, 333333, 3, 2).
+		SetVal([]interface{}{int64(333333), int64(1700000000666666), int64(1700000000000000)})
+	mock.ExpectEvalSha(cancelHashVal, []string{key}, 1700000000666666, 1700000000000000).
+		SetErr(errors.New("connection refused"))
+
+	breaker := ratelimit.NewCircuitBreaker(1, time.Minute)
+	limiter, err := NewLeakyBucketLimiter(context.Background(), db, key,
+		time.Second,
+		3, WithAntiDDos(false),
+		WithDegradation(ratelimit.Degradation{Mode: ratelimit.FailClosed, Breaker: breaker}))
+	assert.Nil(t, err)
+
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	// the cancel fails like the other requests to redis
+	r.Cancel()
+	assert.True(t, breaker.Open())
+}
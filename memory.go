@@ -0,0 +1,615 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the expired keys are removed once in a while, besides when they are read
+const memorySweepInterval = time.Minute
+
+/*
+ErrMemoryOverrides is returned by MemoryBackend when the limits of Overrides are asked for,
+the hash is in redis, so WithOverrides doesn't work with MemoryBackend.
+*/
+var ErrMemoryOverrides = errors.New("the limits of Overrides can't be read by MemoryBackend")
+
+/*
+MemoryBackend runs the algorithms on a map in memory, it is meant for tests and single instances,
+the local limiters of the packages run on it as well.
+The algorithms are the scripts in AlgMap ported to Go, with the same keys, arguments and results,
+but the limits of Overrides are not read, because the hash is in redis, ErrMemoryOverrides is returned instead.
+*/
+type MemoryBackend struct {
+	mu      sync.Mutex
+	values  map[string]*memoryValue
+	sweptAt time.Time
+	// the clock of the algorithms, the scripts use TIME of redis
+	now func() time.Time
+}
+
+// a key of redis, a string is number, a hash is hash and a sorted set is zset
+type memoryValue struct {
+	number float64
+	hash   map[string]float64
+	zset   map[string]float64
+	// in microseconds, 0 means the key never expires
+	expireAt float64
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{values: make(map[string]*memoryValue), sweptAt: time.Now(), now: time.Now}
+}
+
+func (m *MemoryBackend) Run(ctx context.Context, alg int, keys []string, args ...interface{}) (interface{}, error) {
+	run, ok := memoryAlgs[alg]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %v", AlgName(alg))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%v: the key is missing", AlgName(alg))
+	}
+	// KEYS[2] is the hash of Overrides
+	if len(keys) > 1 {
+		return nil, ErrMemoryOverrides
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.now()
+	now := float64(t.UnixMicro())
+	if t.Sub(m.sweptAt) >= memorySweepInterval {
+		m.sweep(now)
+		m.sweptAt = t
+	}
+	a := memoryArgs{values: args}
+	x, err := run(m, now, keys[0], &a)
+	if a.err != nil {
+		return nil, fmt.Errorf("%v: %w", AlgName(alg), a.err)
+	}
+	return x, err
+}
+
+// Len returns the number of keys which haven't expired.
+func (m *MemoryBackend) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(float64(m.now().UnixMicro()))
+	return len(m.values)
+}
+
+func (m *MemoryBackend) sweep(now float64) {
+	for key, v := range m.values {
+		if v.expired(now) {
+			delete(m.values, key)
+		}
+	}
+}
+
+func (v *memoryValue) expired(now float64) bool {
+	return v.expireAt > 0 && v.expireAt <= now
+}
+
+// get returns nil if key doesn't exist
+func (m *MemoryBackend) get(key string, now float64) *memoryValue {
+	v, ok := m.values[key]
+	if !ok {
+		return nil
+	}
+	if v.expired(now) {
+		delete(m.values, key)
+		return nil
+	}
+	return v
+}
+
+// getOrCreate keeps the TTL of key like INCRBY, HSET and ZADD
+func (m *MemoryBackend) getOrCreate(key string, now float64) *memoryValue {
+	v := m.get(key, now)
+	if v == nil {
+		v = &memoryValue{}
+		m.values[key] = v
+	}
+	return v
+}
+
+// number returns 0 if key doesn't exist, like tonumber(redis.call("GET", key) or "0")
+func (m *MemoryBackend) number(key string, now float64) (float64, bool) {
+	v := m.get(key, now)
+	if v == nil {
+		return 0, false
+	}
+	return v.number, true
+}
+
+// set is SET key n PX px, the key never expires if px is 0
+func (m *MemoryBackend) set(key string, now float64, n float64, px float64) {
+	v := &memoryValue{number: n}
+	if px > 0 {
+		v.expireAt = now + px*1000
+	}
+	m.values[key] = v
+}
+
+func (m *MemoryBackend) incrBy(key string, now float64, n float64) {
+	m.getOrCreate(key, now).number += n
+}
+
+func (m *MemoryBackend) pexpire(key string, now float64, px float64) {
+	v := m.get(key, now)
+	if v == nil {
+		return
+	}
+	if px <= 0 {
+		delete(m.values, key)
+		return
+	}
+	v.expireAt = now + px*1000
+}
+
+// hash returns nil if key doesn't exist, the missing fields are 0
+func (m *MemoryBackend) hash(key string, now float64) map[string]float64 {
+	v := m.get(key, now)
+	if v == nil {
+		return nil
+	}
+	return v.hash
+}
+
+func (m *MemoryBackend) hset(key string, now float64, field string, n float64) {
+	v := m.getOrCreate(key, now)
+	if v.hash == nil {
+		v.hash = make(map[string]float64)
+	}
+	v.hash[field] = n
+}
+
+func (m *MemoryBackend) zadd(key string, now float64, score float64, member string) {
+	v := m.getOrCreate(key, now)
+	if v.zset == nil {
+		v.zset = make(map[string]float64)
+	}
+	v.zset[member] = score
+}
+
+// zscores returns the scores of the sorted set in ascending order
+func (m *MemoryBackend) zscores(key string, now float64) []float64 {
+	v := m.get(key, now)
+	if v == nil {
+		return nil
+	}
+	scores := make([]float64, 0, len(v.zset))
+	for _, score := range v.zset {
+		scores = append(scores, score)
+	}
+	sort.Float64s(scores)
+	return scores
+}
+
+// zremRangeByScore removes the members whose scores are not greater than max
+func (m *MemoryBackend) zremRangeByScore(key string, now float64, max float64) {
+	v := m.get(key, now)
+	if v == nil {
+		return
+	}
+	for member, score := range v.zset {
+		if score <= max {
+			delete(v.zset, member)
+		}
+	}
+	if len(v.zset) == 0 {
+		delete(m.values, key)
+	}
+}
+
+func (m *MemoryBackend) zrem(key string, now float64, member string) bool {
+	v := m.get(key, now)
+	if v == nil {
+		return false
+	}
+	if _, ok := v.zset[member]; !ok {
+		return false
+	}
+	delete(v.zset, member)
+	if len(v.zset) == 0 {
+		delete(m.values, key)
+	}
+	return true
+}
+
+// memoryArgs converts the arguments like tonumber, the first error is kept in err
+type memoryArgs struct {
+	values []interface{}
+	err    error
+}
+
+func (a *memoryArgs) float(i int) float64 {
+	if a.err != nil {
+		return 0
+	}
+	if i >= len(a.values) {
+		a.err = fmt.Errorf("ARGV[%d] is missing", i+1)
+		return 0
+	}
+	switch v := a.values[i].(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	f, err := strconv.ParseFloat(a.string(i), 64)
+	if err != nil {
+		a.err = fmt.Errorf("ARGV[%d] is not a number", i+1)
+	}
+	return f
+}
+
+func (a *memoryArgs) string(i int) string {
+	if a.err != nil {
+		return ""
+	}
+	if i >= len(a.values) {
+		a.err = fmt.Errorf("ARGV[%d] is missing", i+1)
+		return ""
+	}
+	return fmt.Sprint(a.values[i])
+}
+
+// ints converts the numbers of a script to the integers of redis, the fractions are dropped
+func ints(values ...float64) []interface{} {
+	x := make([]interface{}, len(values))
+	for i, v := range values {
+		x[i] = int64(v)
+	}
+	return x
+}
+
+func windowKey(prefix string, window float64) string {
+	return prefix + ":" + strconv.FormatInt(int64(window), 10)
+}
+
+var memoryAlgs = map[int]func(m *MemoryBackend, now float64, key string, a *memoryArgs) (interface{}, error){
+	CounterAlg:            (*MemoryBackend).counter,
+	TokenBucketAlg:        (*MemoryBackend).tokenBucket,
+	LeakyBucketAlg:        (*MemoryBackend).leakyBucket,
+	CounterReserveAlg:     (*MemoryBackend).counterReserve,
+	TokenBucketReserveAlg: (*MemoryBackend).tokenBucketReserve,
+	LeakyBucketReserveAlg: (*MemoryBackend).leakyBucketReserve,
+	LeakyBucketCancelAlg:  (*MemoryBackend).leakyBucketCancel,
+	SlidingLogAlg:         (*MemoryBackend).slidingLog,
+	SlidingWindowAlg:      (*MemoryBackend).slidingWindow,
+	GCRAAlg:               (*MemoryBackend).gcra,
+	ConcurrencyAcquireAlg: (*MemoryBackend).concurrencyAcquire,
+	ConcurrencyRenewAlg:   (*MemoryBackend).concurrencyRenew,
+	CounterRefundAlg:      (*MemoryBackend).counterRefund,
+	TokenBucketRefundAlg:  (*MemoryBackend).tokenBucketRefund,
+	ConcurrencyReleaseAlg: (*MemoryBackend).concurrencyRelease,
+	TokenBucketCancelAlg:  (*MemoryBackend).tokenBucketCancel,
+}
+
+// see counterScript
+func (m *MemoryBackend) counter(now float64, keyPrefix string, a *memoryArgs) (interface{}, error) {
+	unit, throughput, batchSize, required := a.float(0), a.float(1), a.float(2), a.float(3)
+	window := math.Floor(now / unit)
+	key := windowKey(keyPrefix, window)
+	reset := (window+1)*unit - now
+	n, _ := m.number(key, now)
+	if throughput-n < required {
+		return ints(0, throughput-n, reset, window, throughput), nil
+	}
+	increment := math.Min(throughput-n, math.Max(batchSize, required))
+	m.incrBy(key, now, increment)
+	m.pexpire(key, now, math.Ceil(3*unit/1000))
+	return ints(increment, throughput-n-increment, reset, window, throughput), nil
+}
+
+// see TokenBucketScript
+func (m *MemoryBackend) tokenBucket(now float64, bucket string, a *memoryArgs) (interface{}, error) {
+	throughputPerSec, batchSize, maxCapacity, required := a.float(0), a.float(1), a.float(2), a.float(3)
+	h := m.hash(bucket, now)
+	increment := (now - h["updateTime"]) / 1000000 * throughputPerSec
+	n := math.Min(h["token_count"]+increment, maxCapacity)
+
+	count, retryAfter := 0.0, 0.0
+	if n >= required {
+		count = math.Floor(math.Min(n, math.Max(batchSize, required)))
+		n -= count
+	} else {
+		retryAfter = math.Ceil((required - n) / throughputPerSec * 1000000)
+	}
+
+	m.hset(bucket, now, "token_count", n)
+	m.hset(bucket, now, "updateTime", now)
+	reset := math.Ceil((maxCapacity - n) / throughputPerSec * 1000000)
+	m.pexpire(bucket, now, math.Max(math.Ceil(reset/1000), 1))
+	return ints(count, math.Floor(n), retryAfter, reset, maxCapacity), nil
+}
+
+// see LeakyBucketScript
+func (m *MemoryBackend) leakyBucket(now float64, bucket string, a *memoryArgs) (interface{}, error) {
+	interval, throughput, required := a.float(0), a.float(1), a.float(2)
+	lastUpdateTime, _ := m.number(bucket, now)
+	count := 0.0
+	if now > lastUpdateTime+interval && required <= throughput {
+		count = required
+		lastUpdateTime = now + (required-1)*interval
+		m.set(bucket, now, lastUpdateTime, math.Ceil((lastUpdateTime+interval-now)/1000))
+	}
+	return ints(count, lastUpdateTime+interval-now, throughput, interval), nil
+}
+
+// see counterReserveScript
+func (m *MemoryBackend) counterReserve(now float64, keyPrefix string, a *memoryArgs) (interface{}, error) {
+	unit, throughput, required := a.float(0), a.float(1), a.float(2)
+	window := math.Floor(now / unit)
+	for i := 0.0; i <= 1; i++ {
+		key := windowKey(keyPrefix, window+i)
+		n, _ := m.number(key, now)
+		if throughput-n >= required {
+			m.incrBy(key, now, required)
+			m.pexpire(key, now, math.Ceil(3*unit/1000))
+			delay := 0.0
+			if i > 0 {
+				delay = (window+1)*unit - now
+			}
+			return ints(delay, window+i), nil
+		}
+	}
+	return ints(-1, 0), nil
+}
+
+// see TokenBucketReserveScript
+func (m *MemoryBackend) tokenBucketReserve(now float64, bucket string, a *memoryArgs) (interface{}, error) {
+	throughputPerSec, maxCapacity, required := a.float(0), a.float(1), a.float(2)
+	if required > maxCapacity {
+		return ints(-1, 0), nil
+	}
+	h := m.hash(bucket, now)
+	increment := (now - h["updateTime"]) / 1000000 * throughputPerSec
+	n := math.Min(h["token_count"]+increment, maxCapacity) - required
+
+	delay := 0.0
+	if n < 0 {
+		delay = math.Ceil(-n / throughputPerSec * 1000000)
+	}
+	timeToAct := now + delay
+	m.hset(bucket, now, "token_count", n)
+	m.hset(bucket, now, "updateTime", now)
+	m.hset(bucket, now, "lastEvent", timeToAct)
+	m.pexpire(bucket, now, math.Max(math.Ceil((maxCapacity-n)/throughputPerSec*1000), 1))
+	return ints(delay, timeToAct), nil
+}
+
+// see LeakyBucketReserveScript
+func (m *MemoryBackend) leakyBucketReserve(now float64, bucket string, a *memoryArgs) (interface{}, error) {
+	interval, throughput, required := a.float(0), a.float(1), a.float(2)
+	if required > throughput {
+		return ints(-1, 0, 0), nil
+	}
+	lastUpdateTime, _ := m.number(bucket, now)
+	start := math.Max(now, lastUpdateTime+interval)
+	updateTime := start + (required-1)*interval
+	m.set(bucket, now, updateTime, math.Ceil((updateTime+interval-now)/1000))
+	return ints(start-now, updateTime, lastUpdateTime), nil
+}
+
+// see LeakyBucketCancelScript
+func (m *MemoryBackend) leakyBucketCancel(now float64, bucket string, a *memoryArgs) (interface{}, error) {
+	updateTime, lastUpdateTime := a.float(0), a.float(1)
+	v := m.get(bucket, now)
+	if v == nil || v.number != updateTime {
+		return int64(0), nil
+	}
+	// the TTL of the reservation is kept
+	v.number = lastUpdateTime
+	return int64(1), nil
+}
+
+// see SlidingLogScript
+func (m *MemoryBackend) slidingLog(now float64, key string, a *memoryArgs) (interface{}, error) {
+	window, throughput, required := a.float(0), a.float(1), a.float(2)
+	m.zremRangeByScore(key, now, now-window)
+	scores := m.zscores(key, now)
+	n := float64(len(scores))
+
+	count, retryAfter := 0.0, 0.0
+	if throughput-n >= required {
+		count = required
+		sec, usec := int64(now)/1000000, int64(now)%1000000
+		for i := 1.0; i <= required; i++ {
+			m.zadd(key, now, now, fmt.Sprintf("%d.%d-%d", sec, usec, int64(n+i)))
+		}
+		n += required
+		m.pexpire(key, now, math.Ceil(window/1000))
+		scores = append(scores, now)
+	} else {
+		// wait until enough entries are removed
+		i := int(n - throughput + required - 1)
+		if i < 0 || i >= len(scores) {
+			return nil, fmt.Errorf("%v permits never fit in the window of %v", required, throughput)
+		}
+		retryAfter = scores[i] + window - now
+	}
+
+	reset := 0.0
+	if n > 0 {
+		reset = scores[len(scores)-1] + window - now
+	}
+	return ints(count, throughput-n, retryAfter, reset), nil
+}
+
+// see SlidingWindowScript
+func (m *MemoryBackend) slidingWindow(now float64, keyPrefix string, a *memoryArgs) (interface{}, error) {
+	unit, throughput, required := a.float(0), a.float(1), a.float(2)
+	window := math.Floor(now / unit)
+	key := windowKey(keyPrefix, window)
+	current, _ := m.number(key, now)
+	previous, _ := m.number(windowKey(keyPrefix, window-1), now)
+	// the part of the current window which has passed
+	elapsed := (now - window*unit) / unit
+
+	count, retryAfter := 0.0, 0.0
+	if throughput-(previous*(1-elapsed)+current) >= required {
+		count = required
+		current += required
+		m.incrBy(key, now, required)
+		m.pexpire(key, now, math.Ceil(2*unit/1000))
+	} else if current+required <= throughput {
+		// wait until the weight of the previous window decreases enough
+		retryAfter = math.Ceil(((1 - (throughput-current-required)/previous) - elapsed) * unit)
+	} else {
+		// wait until the current window becomes the previous one and its weight decreases enough
+		nextElapsed := math.Max(1-(throughput-required)/current, 0)
+		retryAfter = math.Ceil((window+1+nextElapsed)*unit - now)
+	}
+
+	remaining := math.Floor(throughput - (previous*(1-elapsed) + current))
+	reset := 0.0
+	if current > 0 {
+		reset = (window+2)*unit - now
+	} else if previous > 0 {
+		reset = (window+1)*unit - now
+	}
+	return ints(count, math.Max(remaining, 0), retryAfter, reset), nil
+}
+
+// see GCRAScript
+func (m *MemoryBackend) gcra(now float64, key string, a *memoryArgs) (interface{}, error) {
+	interval, burst, required := a.float(0), a.float(1), a.float(2)
+	tat, _ := m.number(key, now)
+	tat = math.Max(tat, now)
+	newTat := tat + required*interval
+	allowAt := newTat - burst*interval
+
+	count, retryAfter := 0.0, 0.0
+	if allowAt <= now {
+		count = required
+		tat = newTat
+		m.set(key, now, tat, math.Ceil((tat-now)/1000))
+	} else {
+		retryAfter = allowAt - now
+	}
+
+	remaining := math.Floor((now - (tat - burst*interval)) / interval)
+	return ints(count, math.Max(remaining, 0), retryAfter, tat-now), nil
+}
+
+// see ConcurrencyAcquireScript
+func (m *MemoryBackend) concurrencyAcquire(now float64, key string, a *memoryArgs) (interface{}, error) {
+	limit, ttl, leaseID := a.float(0), a.float(1), a.string(2)
+	m.zremRangeByScore(key, now, now)
+	scores := m.zscores(key, now)
+	n := float64(len(scores))
+	if n >= limit {
+		return ints(0, n, scores[0]-now), nil
+	}
+
+	m.zadd(key, now, now+ttl, leaseID)
+	// the key lives as long as the latest lease
+	scores = m.zscores(key, now)
+	m.pexpire(key, now, math.Ceil((scores[len(scores)-1]-now)/1000))
+	return ints(1, n+1, 0), nil
+}
+
+// see ConcurrencyRenewScript
+func (m *MemoryBackend) concurrencyRenew(now float64, key string, a *memoryArgs) (interface{}, error) {
+	ttl, leaseID := a.float(0), a.string(1)
+	v := m.get(key, now)
+	if v == nil {
+		return int64(0), nil
+	}
+	expiration, ok := v.zset[leaseID]
+	if !ok || expiration <= now {
+		return int64(0), nil
+	}
+
+	m.zadd(key, now, now+ttl, leaseID)
+	scores := m.zscores(key, now)
+	m.pexpire(key, now, math.Ceil((scores[len(scores)-1]-now)/1000))
+	return int64(1), nil
+}
+
+// see CounterRefundScript
+func (m *MemoryBackend) counterRefund(now float64, key string, a *memoryArgs) (interface{}, error) {
+	refund := a.float(0)
+	n, ok := m.number(key, now)
+	if !ok {
+		return int64(0), nil
+	}
+	refund = math.Min(refund, n)
+	m.incrBy(key, now, -refund)
+	return int64(refund), nil
+}
+
+// see TokenBucketRefundScript
+func (m *MemoryBackend) tokenBucketRefund(now float64, bucket string, a *memoryArgs) (interface{}, error) {
+	throughputPerSec, maxCapacity, refund := a.float(0), a.float(1), a.float(2)
+	h := m.hash(bucket, now)
+	lastUpdateTime, ok := h["updateTime"]
+	// a missing key is a full bucket
+	if !ok {
+		return int64(0), nil
+	}
+
+	increment := (now - lastUpdateTime) / 1000000 * throughputPerSec
+	n := math.Min(h["token_count"]+increment, maxCapacity)
+	refund = math.Min(refund, maxCapacity-n)
+	n += refund
+
+	m.hset(bucket, now, "token_count", n)
+	m.hset(bucket, now, "updateTime", now)
+	m.pexpire(bucket, now, math.Max(math.Ceil((maxCapacity-n)/throughputPerSec*1000), 1))
+	return int64(math.Floor(refund)), nil
+}
+
+// see ConcurrencyReleaseScript
+func (m *MemoryBackend) concurrencyRelease(now float64, key string, a *memoryArgs) (interface{}, error) {
+	if m.zrem(key, now, a.string(0)) {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+// see TokenBucketCancelScript
+func (m *MemoryBackend) tokenBucketCancel(now float64, bucket string, a *memoryArgs) (interface{}, error) {
+	throughputPerSec, maxCapacity, required, timeToAct := a.float(0), a.float(1), a.float(2), a.float(3)
+	h := m.hash(bucket, now)
+	lastUpdateTime, ok := h["updateTime"]
+	// a missing key is a full bucket
+	if !ok || timeToAct < now {
+		return int64(0), nil
+	}
+	lastEvent, ok := h["lastEvent"]
+	if !ok {
+		lastEvent = timeToAct
+	}
+	restore := required - (lastEvent-timeToAct)/1000000*throughputPerSec
+	if restore <= 0 {
+		return int64(0), nil
+	}
+
+	increment := (now - lastUpdateTime) / 1000000 * throughputPerSec
+	n := math.Min(h["token_count"]+increment, maxCapacity)
+	restore = math.Min(restore, maxCapacity-n)
+	n += restore
+
+	m.hset(bucket, now, "token_count", n)
+	m.hset(bucket, now, "updateTime", now)
+	if timeToAct == lastEvent {
+		// the previous reservation becomes the latest one
+		prevEvent := timeToAct - required/throughputPerSec*1000000
+		if prevEvent >= now {
+			m.hset(bucket, now, "lastEvent", prevEvent)
+		}
+	}
+	m.pexpire(bucket, now, math.Max(math.Ceil((maxCapacity-n)/throughputPerSec*1000), 1))
+	return int64(math.Floor(restore)), nil
+}
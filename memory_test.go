@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// TestMemoryBackend runs every algorithm with the scripts on miniredis and with MemoryBackend,
+// both on the same clock, and compares the results.
+func TestMemoryBackend(t *testing.T) {
+	// not at the start of a window
+	start := time.Unix(1700000000, 250000000)
+	startMicro := start.UnixMicro()
+	windowKey := fmt.Sprintf("counter:%d", startMicro/1000000)
+
+	type step struct {
+		at   time.Duration
+		alg  int
+		key  string
+		args []interface{}
+	}
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"counter", []step{
+			{0, CounterAlg, "counter", []interface{}{1000000, 3, 2, 1}},
+			{100 * time.Millisecond, CounterAlg, "counter", []interface{}{1000000, 3, 2, 2}},
+			{200 * time.Millisecond, CounterAlg, "counter", []interface{}{1000000, 3, 2, 1}},
+			{300 * time.Millisecond, CounterRefundAlg, windowKey, []interface{}{5}},
+			{400 * time.Millisecond, CounterAlg, "counter", []interface{}{1000000, 3, 2, 3}},
+			// the next window
+			{800 * time.Millisecond, CounterAlg, "counter", []interface{}{1000000, 3, 2, 2}},
+			{800 * time.Millisecond, CounterReserveAlg, "counter", []interface{}{1000000, 3, 2}},
+			{800 * time.Millisecond, CounterReserveAlg, "counter", []interface{}{1000000, 3, 2}},
+			{4 * time.Second, CounterRefundAlg, windowKey, []interface{}{1}},
+		}},
+		{"token_bucket", []step{
+			{0, TokenBucketAlg, "bucket", []interface{}{10, 2, 5, 1}},
+			{10 * time.Millisecond, TokenBucketAlg, "bucket", []interface{}{10, 2, 5, 4}},
+			{20 * time.Millisecond, TokenBucketAlg, "bucket", []interface{}{10, 2, 5, 2}},
+			{150 * time.Millisecond, TokenBucketRefundAlg, "bucket", []interface{}{10, 5, 2}},
+			{200 * time.Millisecond, TokenBucketReserveAlg, "bucket", []interface{}{10, 5, 4}},
+			{210 * time.Millisecond, TokenBucketReserveAlg, "bucket", []interface{}{10, 5, 3}},
+			{220 * time.Millisecond, TokenBucketAlg, "bucket", []interface{}{10, 2, 5, 1}},
+			{230 * time.Millisecond, TokenBucketRefundAlg, "bucket", []interface{}{10, 5, 20}},
+			{2 * time.Second, TokenBucketAlg, "bucket", []interface{}{10, 2, 5, 5}},
+		}},
+		{"token_bucket_cancel", []step{
+			{0, TokenBucketReserveAlg, "bucket", []interface{}{10, 4, 4}},
+			{0, TokenBucketReserveAlg, "bucket", []interface{}{10, 4, 2}},
+			{0, TokenBucketReserveAlg, "bucket", []interface{}{10, 4, 2}},
+			{0, TokenBucketCancelAlg, "bucket", []interface{}{10, 4, 2, startMicro + 200000}},
+			{0, TokenBucketCancelAlg, "bucket", []interface{}{10, 4, 2, startMicro + 400000}},
+			{100 * time.Millisecond, TokenBucketCancelAlg, "bucket", []interface{}{10, 4, 2, startMicro + 200000}},
+			{300 * time.Millisecond, TokenBucketCancelAlg, "bucket", []interface{}{10, 4, 2, startMicro + 200000}},
+			{300 * time.Millisecond, TokenBucketAlg, "bucket", []interface{}{10, 1, 4, 1}},
+			{300 * time.Millisecond, TokenBucketReserveAlg, "bucket", []interface{}{10, 4, 5}},
+			{time.Second, TokenBucketCancelAlg, "missing", []interface{}{10, 4, 2, startMicro + 2000000}},
+		}},
+		{"leaky_bucket", []step{
+			{0, LeakyBucketAlg, "leaky", []interface{}{100000, 10, 1}},
+			{50 * time.Millisecond, LeakyBucketAlg, "leaky", []interface{}{100000, 10, 1}},
+			{150 * time.Millisecond, LeakyBucketAlg, "leaky", []interface{}{100000, 10, 3}},
+			{200 * time.Millisecond, LeakyBucketAlg, "leaky", []interface{}{100000, 10, 1}},
+			{500 * time.Millisecond, LeakyBucketAlg, "leaky", []interface{}{100000, 10, 11}},
+			{time.Second, LeakyBucketReserveAlg, "leaky", []interface{}{100000, 10, 2}},
+			{time.Second, LeakyBucketReserveAlg, "leaky", []interface{}{100000, 10, 11}},
+			{time.Second, LeakyBucketCancelAlg, "leaky", []interface{}{startMicro + 1100000, 0}},
+			{time.Second, LeakyBucketCancelAlg, "leaky", []interface{}{startMicro + 1100000, 0}},
+		}},
+		{"sliding_log", []step{
+			{0, SlidingLogAlg, "log", []interface{}{1000000, 3, 2}},
+			{400 * time.Millisecond, SlidingLogAlg, "log", []interface{}{1000000, 3, 1}},
+			{500 * time.Millisecond, SlidingLogAlg, "log", []interface{}{1000000, 3, 2}},
+			{1100 * time.Millisecond, SlidingLogAlg, "log", []interface{}{1000000, 3, 2}},
+			{1200 * time.Millisecond, SlidingLogAlg, "log", []interface{}{1000000, 3, 1}},
+		}},
+		{"sliding_window", []step{
+			{0, SlidingWindowAlg, "window", []interface{}{1000000, 10, 8}},
+			{900 * time.Millisecond, SlidingWindowAlg, "window", []interface{}{1000000, 10, 3}},
+			{1000 * time.Millisecond, SlidingWindowAlg, "window", []interface{}{1000000, 10, 3}},
+			{1500 * time.Millisecond, SlidingWindowAlg, "window", []interface{}{1000000, 10, 2}},
+			{1600 * time.Millisecond, SlidingWindowAlg, "window", []interface{}{1000000, 10, 9}},
+			{1700 * time.Millisecond, SlidingWindowAlg, "window", []interface{}{1000000, 10, 10}},
+		}},
+		{"gcra", []step{
+			{0, GCRAAlg, "gcra", []interface{}{100000, 3, 2}},
+			{10 * time.Millisecond, GCRAAlg, "gcra", []interface{}{100000, 3, 2}},
+			{20 * time.Millisecond, GCRAAlg, "gcra", []interface{}{100000, 3, 1}},
+			{150 * time.Millisecond, GCRAAlg, "gcra", []interface{}{100000, 3, 1}},
+			{time.Second, GCRAAlg, "gcra", []interface{}{100000, 3, 3}},
+		}},
+		{"concurrency", []step{
+			{0, ConcurrencyAcquireAlg, "leases", []interface{}{2, 1000000, "a"}},
+			{100 * time.Millisecond, ConcurrencyAcquireAlg, "leases", []interface{}{2, 1000000, "b"}},
+			{200 * time.Millisecond, ConcurrencyAcquireAlg, "leases", []interface{}{2, 1000000, "c"}},
+			{500 * time.Millisecond, ConcurrencyRenewAlg, "leases", []interface{}{1000000, "a"}},
+			{600 * time.Millisecond, ConcurrencyReleaseAlg, "leases", []interface{}{"b"}},
+			{600 * time.Millisecond, ConcurrencyReleaseAlg, "leases", []interface{}{"b"}},
+			{700 * time.Millisecond, ConcurrencyAcquireAlg, "leases", []interface{}{2, 1000000, "c"}},
+			{1600 * time.Millisecond, ConcurrencyRenewAlg, "leases", []interface{}{1000000, "a"}},
+			{1600 * time.Millisecond, ConcurrencyAcquireAlg, "leases", []interface{}{2, 1000000, "d"}},
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+			defer client.Close()
+			scripts := NewRedisBackend(client, EvalMode)
+
+			now := start
+			memory := NewMemoryBackend()
+			memory.now = func() time.Time { return now }
+			s.SetTime(now)
+			for i, st := range c.steps {
+				// the keys expire in miniredis only when time is fast forwarded
+				s.FastForward(start.Add(st.at).Sub(now))
+				now = start.Add(st.at)
+				s.SetTime(now)
+
+				expected, err := scripts.Run(context.Background(), st.alg, []string{st.key}, st.args...)
+				assert.Nil(t, err, "step %d", i)
+				actual, err := memory.Run(context.Background(), st.alg, []string{st.key}, st.args...)
+				assert.Nil(t, err, "step %d", i)
+				assert.Equal(t, expected, actual, "step %d of %v", i, AlgName(st.alg))
+			}
+		})
+	}
+}
+
+func TestMemoryBackendOverrides(t *testing.T) {
+	memory := NewMemoryBackend()
+	_, err := memory.Run(context.Background(), CounterAlg, []string{"counter", DefaultOverridesKey},
+		1000000, 3, 1, 1)
+	assert.Equal(t, ErrMemoryOverrides, err)
+}
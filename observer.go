@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+/*
+Observer is notified of what happens in the limiters, such as the decisions and the requests to redis,
+it must be safe for concurrent use and return quickly.
+Embed NopObserver to implement only a part of it.
+*/
+type Observer interface {
+	// OnDecision is called with the result of every TakeDecision, TakeN and Take.
+	OnDecision(info ObserverInfo, e DecisionEvent)
+	// OnFetch is called after redis is requested for permits.
+	OnFetch(info ObserverInfo, e FetchEvent)
+	// OnError is called when an error is returned to the caller.
+	OnError(info ObserverInfo, err error)
+	// OnWait is called when Wait or WaitN returns.
+	OnWait(info ObserverInfo, e WaitEvent)
+}
+
+// ObserverInfo describes the limiter which notifies the Observer.
+type ObserverInfo struct {
+	// Name is set by WithName of every package, it is empty by default.
+	Name string
+	// Algorithm is the name of the algorithm, such as "counter" and "token_bucket".
+	Algorithm string
+	Key       string
+}
+
+type DecisionEvent struct {
+	N        int
+	Decision Decision
+	// Local is true if the permits are taken from the ones cached locally.
+	Local bool
+}
+
+type FetchEvent struct {
+	// Count is the number of permits which are fetched.
+	Count   int
+	Latency time.Duration
+	// Prefetch is true if the permits are fetched in advance by PreFetch.
+	Prefetch bool
+	Err      error
+}
+
+type WaitEvent struct {
+	N      int
+	Waited time.Duration
+	Err    error
+}
+
+// NopObserver does nothing, it can be embedded by the observers which are interested in some of the events.
+type NopObserver struct{}
+
+func (NopObserver) OnDecision(info ObserverInfo, e DecisionEvent) {}
+
+func (NopObserver) OnFetch(info ObserverInfo, e FetchEvent) {}
+
+func (NopObserver) OnError(info ObserverInfo, err error) {}
+
+func (NopObserver) OnWait(info ObserverInfo, e WaitEvent) {}
+
+// ObserverInfo returns the description of the limiter for its Observer.
+func (r *BaseRateLimiter) ObserverInfo() ObserverInfo {
+	return ObserverInfo{Name: r.Name, Algorithm: AlgName(r.Alg), Key: r.Key}
+}
+
+// ObserveDecision notifies the Observer of a decision, or of the error if err is not nil.
+func (r *BaseRateLimiter) ObserveDecision(n int, d Decision, local bool, err error) {
+	if r.Observer == nil {
+		return
+	}
+	if err != nil {
+		r.Observer.OnError(r.ObserverInfo(), err)
+		return
+	}
+	r.Observer.OnDecision(r.ObserverInfo(), DecisionEvent{N: n, Decision: d, Local: local})
+}
+
+// ObserveFetch notifies the Observer of a request to redis which starts at start.
+func (r *BaseRateLimiter) ObserveFetch(count int, start time.Time, prefetch bool, err error) {
+	if r.Observer == nil {
+		return
+	}
+	r.Observer.OnFetch(r.ObserverInfo(), FetchEvent{
+		Count:    count,
+		Latency:  time.Since(start),
+		Prefetch: prefetch,
+		Err:      err,
+	})
+}
+
+// ObserveWait notifies the Observer of a wait which starts at start.
+func (r *BaseRateLimiter) ObserveWait(n int, start time.Time, err error) {
+	if r.Observer == nil {
+		return
+	}
+	r.Observer.OnWait(r.ObserverInfo(), WaitEvent{N: n, Waited: time.Since(start), Err: err})
+}
@@ -0,0 +1,76 @@
+/*
+Package otel traces the limiters with OpenTelemetry, it is a module of its own,
+so the limiters which are not traced don't depend on OpenTelemetry.
+
+	limiter, err := tokenbucket.NewTokenBucketRateLimiter(ctx, client, "key:token", time.Second, 100, 10, 5,
+		tokenbucket.WithTracer(ratelimitotel.NewTracer(otel.GetTracerProvider())))
+*/
+package otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/vearne/ratelimit"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer which is got from the TracerProvider given to NewTracer.
+const TracerName = "github.com/vearne/ratelimit"
+
+// Tracer is a ratelimit.Tracer which starts the spans with an OpenTelemetry tracer.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer creates a Tracer with the tracer of tp named TracerName.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: tp.Tracer(TracerName)}
+}
+
+func (t *Tracer) Start(ctx context.Context, name string,
+	attrs ...ratelimit.Attribute) (context.Context, ratelimit.Span) {
+	ctx, s := t.tracer.Start(ctx, name, trace.WithAttributes(convert(attrs)...))
+	return ctx, span{span: s}
+}
+
+// span adapts trace.Span to ratelimit.Span
+type span struct {
+	span trace.Span
+}
+
+func (s span) SetAttributes(attrs ...ratelimit.Attribute) {
+	s.span.SetAttributes(convert(attrs)...)
+}
+
+func (s span) AddEvent(name string, attrs ...ratelimit.Attribute) {
+	s.span.AddEvent(name, trace.WithAttributes(convert(attrs)...))
+}
+
+func (s span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s span) End() {
+	s.span.End()
+}
+
+func convert(attrs []ratelimit.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		key := string(a.Key)
+		switch v := a.Value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(key, v))
+		default:
+			kvs = append(kvs, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
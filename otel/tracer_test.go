@@ -0,0 +1,85 @@
+package otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"github.com/vearne/ratelimit/counter"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+)
+
+const key = "key:count"
+
+var hashVal = ratelimit.ScriptSHA1(ratelimit.CounterAlg)
+
+func MyMatch(expected, actual []interface{}) error {
+	expectedStr := fmt.Sprintf("%v", expected)
+	actualStr := fmt.Sprintf("%v", actual)
+	if expectedStr == actualStr {
+		return nil
+	}
+	return fmt.Errorf("not equal, expectedStr:%s, actualStr:%s", expectedStr, actualStr)
+}
+
+func attr(key ratelimit.AttributeKey, value string) attribute.KeyValue {
+	return attribute.String(string(key), value)
+}
+
+func TestTracing(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 1, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(100000), int64(1700000000), int64(3)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 1, 1).
+		SetVal([]interface{}{int64(1), int64(2), int64(500000), int64(1700000001), int64(3)})
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	limiter, err := counter.NewCounterRateLimiter(context.Background(), db, key, time.Second,
+		3,
+		1,
+		counter.WithTracer(NewTracer(tp)))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx, parent := tp.Tracer("test").Start(ctx, "parent")
+	err = limiter.Wait(ctx)
+	parent.End()
+	assert.Nil(t, err)
+
+	spans := recorder.Ended()
+	// script, take, script, take, wait, parent
+	assert.Equal(t, 6, len(spans))
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	assert.Equal(t, []string{"ratelimit.script", "ratelimit.Take", "ratelimit.script", "ratelimit.Take",
+		"ratelimit.Wait", "parent"}, names)
+
+	wait := spans[4]
+	assert.Equal(t, parent.SpanContext().SpanID(), wait.Parent().SpanID())
+	assert.Equal(t, 2, len(wait.Events()))
+	assert.Contains(t, wait.Attributes(), attr(ratelimit.AttrAlgorithm, "counter"))
+	assert.Contains(t, wait.Attributes(), attr(ratelimit.AttrKey, key))
+	assert.Contains(t, wait.Attributes(), attr(ratelimit.AttrOutcome, ratelimit.OutcomeAllowed))
+
+	assert.Equal(t, wait.SpanContext().SpanID(), spans[1].Parent().SpanID())
+	assert.Contains(t, spans[1].Attributes(), attr(ratelimit.AttrOutcome, "quota_exhausted"))
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Contains(t, spans[0].Attributes(), attr(ratelimit.AttrScript, "counter"))
+	assert.Contains(t, spans[3].Attributes(), attr(ratelimit.AttrOutcome, ratelimit.OutcomeAllowed))
+}
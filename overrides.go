@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// DefaultOverridesKey is a suggested name of the hash which keeps the limits of the keys.
+const DefaultOverridesKey = "ratelimit:overrides"
+
+/*
+Override is the limit of a key which replaces the one given to the constructor,
+throughput permits per duration, Burst is the capacity of the token bucket, Throughput if it is 0.
+*/
+type Override struct {
+	Duration   time.Duration
+	Throughput int
+	Burst      int
+}
+
+// the value in the hash, the scripts decode it with cjson
+type overrideValue struct {
+	Throughput int     `json:"throughput"`
+	DurationMs float64 `json:"duration_ms"`
+	Burst      int     `json:"burst,omitempty"`
+}
+
+func (o Override) check() error {
+	if o.Duration < time.Millisecond {
+		return errors.New("duration is too small")
+	}
+	if o.Throughput <= 0 {
+		return errors.New("throughput must greater than 0")
+	}
+	if o.Duration/time.Duration(o.Throughput) < time.Microsecond {
+		return errors.New("throughput is too large for the duration")
+	}
+	if o.Burst < 0 {
+		return errors.New("burst can't be negative")
+	}
+	return nil
+}
+
+/*
+Overrides keeps the limits of the keys in a redis hash, the field is the key in redis and the value is JSON,
+such as {"throughput":200,"duration_ms":1000,"burst":400}.
+The counter, the token bucket and the leaky bucket read it with WithOverrides,
+the changes apply to the next request to redis, the keys without an Override use the limits of the constructors.
+*/
+type Overrides struct {
+	client redis.Cmdable
+	key    string
+}
+
+// NewOverrides creates the Overrides kept in the hash key.
+func NewOverrides(client redis.Cmdable, key string) *Overrides {
+	return &Overrides{client: client, key: key}
+}
+
+// Set sets the limit of key.
+func (s *Overrides) Set(ctx context.Context, key string, o Override) error {
+	err := o.check()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(overrideValue{
+		Throughput: o.Throughput,
+		DurationMs: float64(o.Duration) / float64(time.Millisecond),
+		Burst:      o.Burst,
+	})
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(ctx, s.key, key, value).Err()
+}
+
+// Get returns the limit of key, ok is false if key has no limit of its own.
+func (s *Overrides) Get(ctx context.Context, key string) (o Override, ok bool, err error) {
+	value, err := s.client.HGet(ctx, s.key, key).Result()
+	if err == redis.Nil {
+		return Override{}, false, nil
+	}
+	if err != nil {
+		return Override{}, false, err
+	}
+	o, err = decodeOverride(value)
+	if err != nil {
+		return Override{}, false, err
+	}
+	return o, true, nil
+}
+
+// Delete removes the limit of key, then the limit of the constructor is used again.
+func (s *Overrides) Delete(ctx context.Context, key string) error {
+	return s.client.HDel(ctx, s.key, key).Err()
+}
+
+// List returns the limits of all the keys.
+func (s *Overrides) List(ctx context.Context) (map[string]Override, error) {
+	values, err := s.client.HGetAll(ctx, s.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]Override, len(values))
+	for key, value := range values {
+		o, err := decodeOverride(value)
+		if err != nil {
+			return nil, err
+		}
+		overrides[key] = o
+	}
+	return overrides, nil
+}
+
+func decodeOverride(value string) (Override, error) {
+	var v overrideValue
+	err := json.Unmarshal([]byte(value), &v)
+	if err != nil {
+		return Override{}, err
+	}
+	return Override{
+		Duration:   time.Duration(v.DurationMs * float64(time.Millisecond)),
+		Throughput: v.Throughput,
+		Burst:      v.Burst,
+	}, nil
+}
+
+/*
+OverrideKeys returns the KEYS of the scripts which read the limit of r.Key from the hash OverridesKey,
+it is only r.Key if OverridesKey is empty.
+*/
+func (r *BaseRateLimiter) OverrideKeys() []string {
+	if r.OverridesKey == "" {
+		return []string{r.Key}
+	}
+	return []string{r.Key, r.OverridesKey}
+}
@@ -0,0 +1,119 @@
+/*
+Package prometheus exports the events of the limiters as Prometheus metrics.
+
+	collector := prometheus.NewCollector("myapp")
+	registry.MustRegister(collector)
+	limiter, err := counter.NewCounterRateLimiter(ctx, client, "key:count", time.Second, 100, 10,
+		counter.WithName("api"), counter.WithObserver(collector))
+
+All the metrics are labeled by the name and the algorithm of the limiter, the keys are not labels,
+so the keyed limiters don't blow up the number of series.
+*/
+package prometheus
+
+import (
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/vearne/ratelimit"
+	"strconv"
+)
+
+// Collector is both a prometheus.Collector and a ratelimit.Observer.
+type Collector struct {
+	decisions      *prom.CounterVec
+	fetches        *prom.CounterVec
+	fetchedPermits *prom.CounterVec
+	fetchDuration  *prom.HistogramVec
+	errors         *prom.CounterVec
+	waitDuration   *prom.HistogramVec
+}
+
+var _ ratelimit.Observer = (*Collector)(nil)
+
+// NewCollector creates a Collector whose metrics are prefixed by namespace, namespace can be empty.
+func NewCollector(namespace string) *Collector {
+	labels := []string{"name", "algorithm"}
+	return &Collector{
+		decisions: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ratelimit",
+			Name:      "decisions_total",
+			Help:      "The number of decisions, by whether they are allowed, why not, and whether the local permits are used.",
+		}, append(labels, "allowed", "reason", "local")),
+		fetches: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ratelimit",
+			Name:      "fetches_total",
+			Help:      "The number of requests to redis for permits.",
+		}, append(labels, "prefetch", "result")),
+		fetchedPermits: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ratelimit",
+			Name:      "fetched_permits_total",
+			Help:      "The number of permits fetched from redis.",
+		}, labels),
+		fetchDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "ratelimit",
+			Name:      "fetch_duration_seconds",
+			Help:      "The latency of the requests to redis.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, labels),
+		errors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "ratelimit",
+			Name:      "errors_total",
+			Help:      "The number of errors returned to the callers.",
+		}, labels),
+		waitDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "ratelimit",
+			Name:      "wait_duration_seconds",
+			Help:      "How long Wait and WaitN take, by whether the permits are taken.",
+			Buckets:   prom.ExponentialBuckets(.001, 4, 8),
+		}, append(labels, "result")),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	c.decisions.Describe(ch)
+	c.fetches.Describe(ch)
+	c.fetchedPermits.Describe(ch)
+	c.fetchDuration.Describe(ch)
+	c.errors.Describe(ch)
+	c.waitDuration.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	c.decisions.Collect(ch)
+	c.fetches.Collect(ch)
+	c.fetchedPermits.Collect(ch)
+	c.fetchDuration.Collect(ch)
+	c.errors.Collect(ch)
+	c.waitDuration.Collect(ch)
+}
+
+func (c *Collector) OnDecision(info ratelimit.ObserverInfo, e ratelimit.DecisionEvent) {
+	c.decisions.WithLabelValues(info.Name, info.Algorithm,
+		strconv.FormatBool(e.Decision.Allowed), e.Decision.Reason.String(), strconv.FormatBool(e.Local)).Inc()
+}
+
+func (c *Collector) OnFetch(info ratelimit.ObserverInfo, e ratelimit.FetchEvent) {
+	c.fetches.WithLabelValues(info.Name, info.Algorithm, strconv.FormatBool(e.Prefetch), result(e.Err)).Inc()
+	c.fetchedPermits.WithLabelValues(info.Name, info.Algorithm).Add(float64(e.Count))
+	c.fetchDuration.WithLabelValues(info.Name, info.Algorithm).Observe(e.Latency.Seconds())
+}
+
+func (c *Collector) OnError(info ratelimit.ObserverInfo, err error) {
+	c.errors.WithLabelValues(info.Name, info.Algorithm).Inc()
+}
+
+func (c *Collector) OnWait(info ratelimit.ObserverInfo, e ratelimit.WaitEvent) {
+	c.waitDuration.WithLabelValues(info.Name, info.Algorithm, result(e.Err)).Observe(e.Waited.Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
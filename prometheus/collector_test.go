@@ -0,0 +1,77 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redismock/v9"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"github.com/vearne/ratelimit/counter"
+	"testing"
+	"time"
+)
+
+func MyMatch(expected, actual []interface{}) error {
+	expectedStr := fmt.Sprintf("%v", expected)
+	actualStr := fmt.Sprintf("%v", actual)
+	if expectedStr == actualStr {
+		return nil
+	}
+	return fmt.Errorf("not equal, expectedStr:%s, actualStr:%s", expectedStr, actualStr)
+}
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("test")
+	info := ratelimit.ObserverInfo{Name: "api", Algorithm: "counter", Key: "key:count"}
+
+	c.OnDecision(info, ratelimit.DecisionEvent{N: 1, Decision: ratelimit.Decision{Allowed: true}, Local: true})
+	c.OnDecision(info, ratelimit.DecisionEvent{N: 1,
+		Decision: ratelimit.Decision{Reason: ratelimit.ReasonLocalShield}})
+	c.OnFetch(info, ratelimit.FetchEvent{Count: 10, Latency: time.Millisecond})
+	c.OnFetch(info, ratelimit.FetchEvent{Prefetch: true, Err: errors.New("timeout")})
+	c.OnError(info, errors.New("timeout"))
+	c.OnWait(info, ratelimit.WaitEvent{N: 1, Waited: 20 * time.Millisecond})
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.decisions.WithLabelValues("api", "counter", "true", "none", "true")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.decisions.WithLabelValues("api", "counter", "false", "local_shield", "false")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.fetches.WithLabelValues("api", "counter", "false", "ok")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.fetches.WithLabelValues("api", "counter", "true", "error")))
+	assert.Equal(t, 10.0, testutil.ToFloat64(c.fetchedPermits.WithLabelValues("api", "counter")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.errors.WithLabelValues("api", "counter")))
+	// decisions 2, fetches 2, fetched permits 1, fetch duration 1, errors 1, wait duration 1
+	assert.Equal(t, 8, testutil.CollectAndCount(c))
+}
+
+func TestObserveLimiter(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(ratelimit.ScriptSHA1(ratelimit.CounterAlg)).SetVal([]bool{true})
+	mock.ExpectEvalSha(ratelimit.ScriptSHA1(ratelimit.CounterAlg), []string{"key:count"}, 1000000, 3, 2, 1).
+		SetVal([]interface{}{int64(2), int64(1), int64(500000), int64(1700000000), int64(3)})
+
+	c := NewCollector("")
+	registry := prom.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(c))
+
+	limiter, err := counter.NewCounterRateLimiter(context.Background(), db, "key:count", time.Second, 3, 2,
+		counter.WithAntiDDos(false), counter.WithName("api"), counter.WithObserver(c))
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		ok, err := limiter.Take(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	_, err = ratelimit.TakeN(context.Background(), limiter, 4)
+	assert.ErrorIs(t, err, ratelimit.ErrExceedsLimit)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.decisions.WithLabelValues("api", "counter", "true", "none", "false")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.decisions.WithLabelValues("api", "counter", "true", "none", "true")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.fetches.WithLabelValues("api", "counter", "false", "ok")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(c.fetchedPermits.WithLabelValues("api", "counter")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.errors.WithLabelValues("api", "counter")))
+}
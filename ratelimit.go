@@ -2,22 +2,206 @@ package ratelimit
 
 import (
 	"context"
+	"errors"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	ErrInvalidN = errors.New("n must greater than 0")
+	// ErrExceedsLimit is returned by TakeN and WaitN when n is larger than the
+	// number of permits the limiter could ever grant at once,
+	// so waiting would never succeed.
+	ErrExceedsLimit = errors.New("n exceeds the limit of the limiter")
+	// ErrNotMultiTaker is returned by TakeN and WaitN when the limiter takes only one permit at a time.
+	ErrNotMultiTaker = errors.New("the limiter doesn't implement MultiTaker")
+	// ErrClosed is returned by the limiters after Close.
+	ErrClosed = errors.New("limiter is closed")
+	// ErrDeadline is returned by Wait when the permits can't be taken before the deadline of the context.
+	ErrDeadline = errors.New("can't get token before the deadline")
+)
+
 type Limiter interface {
 	Take(ctx context.Context) (bool, error)
 	Wait(ctx context.Context) (err error)
 }
 
+// Closer is implemented by the limiters which have background goroutines or permits cached locally.
+type Closer interface {
+	// Close stops the background goroutines and gives the permits cached locally back,
+	// the limiter can't be used after it.
+	Close(ctx context.Context) error
+}
+
+// Flusher is implemented by the limiters which cache permits locally.
+type Flusher interface {
+	// Flush gives the permits cached locally back, the limiter can still be used after it.
+	Flush(ctx context.Context) error
+}
+
+// Close closes l if it implements Closer.
+func Close(ctx context.Context, l Limiter) error {
+	if c, ok := l.(Closer); ok {
+		return c.Close(ctx)
+	}
+	return nil
+}
+
+// MultiTaker is implemented by the limiters which are able to take more than one permit at once.
+type MultiTaker interface {
+	// TakeN takes n permits at once, either all of them or none.
+	TakeN(ctx context.Context, n int) (bool, error)
+	// WaitN waits until n permits can be taken at once or ctx is done.
+	WaitN(ctx context.Context, n int) (err error)
+}
+
+// TakeN takes n permits of l, ErrNotMultiTaker is returned if n > 1 and l doesn't implement MultiTaker.
+func TakeN(ctx context.Context, l Limiter, n int) (bool, error) {
+	if m, ok := l.(MultiTaker); ok {
+		return m.TakeN(ctx, n)
+	}
+	switch {
+	case n <= 0:
+		return false, ErrInvalidN
+	case n > 1:
+		return false, ErrNotMultiTaker
+	}
+	return l.Take(ctx)
+}
+
+// WaitN waits for n permits of l, ErrNotMultiTaker is returned if n > 1 and l doesn't implement MultiTaker.
+func WaitN(ctx context.Context, l Limiter, n int) error {
+	if m, ok := l.(MultiTaker); ok {
+		return m.WaitN(ctx, n)
+	}
+	switch {
+	case n <= 0:
+		return ErrInvalidN
+	case n > 1:
+		return ErrNotMultiTaker
+	}
+	return l.Wait(ctx)
+}
+
+// LimitSetter is implemented by the limiters whose rate can be changed while they are used.
+type LimitSetter interface {
+	// SetLimit changes the rate to throughput permits per duration.
+	SetLimit(duration time.Duration, throughput int) error
+}
+
+// BurstSetter is implemented by the limiters whose burst can be changed while they are used.
+type BurstSetter interface {
+	SetBurst(burst int) error
+}
+
+// BatchSizeSetter is implemented by the limiters which fetch permits from redis in batches.
+type BatchSizeSetter interface {
+	// SetBatchSize fixes the batch size, an adaptive batch size stops adapting.
+	SetBatchSize(size int) error
+}
+
 // nolint: govet
 type BaseRateLimiter struct {
 	sync.Mutex
-	ScriptSHA1  string
+	ScriptSHA1 string
+	// the algorithm of ScriptSHA1, its script is sent again if redis has lost it
+	Alg         int
 	Key         string
 	RedisClient redis.Cmdable
+	// Backend runs the scripts instead of RedisClient, nil means RedisClient is used.
+	Backend Backend
 	// For interval between requests,the smallest unit of duration is one microseconds.
 	Interval time.Duration
+	// PureEval sends the whole script with EVAL every time, for the redis ACLs which block SCRIPT commands
+	PureEval bool
+	// UseFunctions calls the functions of the library with FCALL instead of the scripts, Redis 7 is required
+	UseFunctions bool
+	// OverridesKey is the hash of Overrides which the scripts read the limit of Key from, empty means none.
+	OverridesKey string
+	// Fallback decides what to do when redis is unavailable, nil means the errors are returned.
+	Fallback *Fallback
+	// Name tells the limiter apart in the Observer.
+	Name string
+	// Observer is notified of the decisions, the requests to redis, the errors and the waits.
+	Observer Observer
+	// Tracer creates the spans of Take, Wait and the scripts, nil means no spans.
+	Tracer Tracer
+
+	closed atomic.Bool
+}
+
+// Close marks the limiter closed, the limiters which cache permits locally give them back as well.
+func (r *BaseRateLimiter) Close(ctx context.Context) error {
+	r.closed.Store(true)
+	return nil
+}
+
+// WaitInterval returns Interval, it may be changed by SetLimit while Wait is polling.
+func (r *BaseRateLimiter) WaitInterval() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	return r.Interval
+}
+
+// Closed reports whether Close has been called.
+func (r *BaseRateLimiter) Closed() bool {
+	return r.closed.Load()
+}
+
+// DefaultAntiDDoSMultiplier is how many times the throughput the local anti-DDoS limiter allows by default.
+const DefaultAntiDDoSMultiplier = 2
+
+/*
+NewAntiDDoSLimiter creates the local limiter which rejects the traffic before redis is requested,
+it allows multiplier times limit, and multiplier times burst at once unless shieldBurst is set.
+multiplier <= 0 means DefaultAntiDDoSMultiplier.
+*/
+func NewAntiDDoSLimiter(limit rate.Limit, burst int, multiplier float64, shieldBurst int) *rate.Limiter {
+	limit, burst = antiDDoSSettings(limit, burst, multiplier, shieldBurst)
+	return rate.NewLimiter(limit, burst)
+}
+
+// ResetAntiDDoSLimiter changes l, which is created by NewAntiDDoSLimiter, for the new limit and burst.
+func ResetAntiDDoSLimiter(l *rate.Limiter, limit rate.Limit, burst int, multiplier float64, shieldBurst int) {
+	limit, burst = antiDDoSSettings(limit, burst, multiplier, shieldBurst)
+	l.SetLimit(limit)
+	l.SetBurst(burst)
+}
+
+func antiDDoSSettings(limit rate.Limit, burst int, multiplier float64, shieldBurst int) (rate.Limit, int) {
+	if multiplier <= 0 {
+		multiplier = DefaultAntiDDoSMultiplier
+	}
+	if shieldBurst <= 0 {
+		shieldBurst = int(math.Ceil(float64(burst) * multiplier))
+	}
+	return limit * rate.Limit(multiplier), shieldBurst
+}
+
+/*
+CheckLimit checks throughput per duration, duration must be at least 1ms,
+and the interval between two permits must be at least 1µs, the smallest unit of the scripts.
+*/
+func CheckLimit(duration time.Duration, throughput int) error {
+	if duration < time.Millisecond {
+		return errors.New("duration is too small")
+	}
+
+	if throughput <= 0 {
+		return errors.New("throughput must greater than 0")
+	}
+
+	if duration/time.Duration(throughput) < time.Microsecond {
+		return errors.New("throughput is too large for the duration")
+	}
+	return nil
+}
+
+// PerSecond converts throughput per duration to a rate per second, duration can be of any length.
+func PerSecond(throughput int, duration time.Duration) rate.Limit {
+	return rate.Limit(float64(throughput) / duration.Seconds())
 }
@@ -0,0 +1,27 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCheckLimit(t *testing.T) {
+	cases := []struct {
+		duration   time.Duration
+		throughput int
+		valid      bool
+	}{
+		{time.Second, 10, true},
+		{time.Millisecond, 1000, true},
+		{time.Microsecond, 10, false},
+		// the interval is 0.1µs
+		{time.Millisecond, 10000, false},
+		{time.Second, 0, false},
+		{time.Second, -1, false},
+	}
+	for _, c := range cases {
+		err := CheckLimit(c.duration, c.throughput)
+		assert.Equal(t, c.valid, err == nil, "%v per %v", c.throughput, c.duration)
+	}
+}
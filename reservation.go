@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"context"
+	slog "github.com/vearne/simplelog"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+// InfDuration is the duration returned by Delay when a Reservation is not OK.
+const InfDuration = rate.InfDuration
+
+// Reserver is implemented by the limiters which are able to reserve permits in advance.
+type Reserver interface {
+	// Reserve reserves n permits, the caller must wait for Delay() before using them,
+	// or call Cancel() if it gives up.
+	Reserve(ctx context.Context, n int) (*Reservation, error)
+}
+
+// Reservation holds information about permits that are reserved by a limiter,
+// just like rate.Reservation in golang.org/x/time/rate.
+type Reservation struct {
+	mu        sync.Mutex
+	ok        bool
+	timeToAct time.Time
+	cancel    func(ctx context.Context) error
+	canceled  bool
+}
+
+// NewReservation creates a Reservation whose permits can be used after delay.
+// cancel gives the permits back to the limiter, it may be nil.
+func NewReservation(ok bool, delay time.Duration, cancel func(ctx context.Context) error) *Reservation {
+	return &Reservation{ok: ok, timeToAct: time.Now().Add(delay), cancel: cancel}
+}
+
+// OK returns whether the limiter can provide the requested permits.
+// If OK is false, Delay returns InfDuration, and Cancel does nothing.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay is shorthand for DelayFrom(time.Now()).
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(time.Now())
+}
+
+// DelayFrom returns the duration for which the reservation holder must wait
+// before using the reserved permits. Zero means act immediately.
+func (r *Reservation) DelayFrom(t time.Time) time.Duration {
+	if !r.ok {
+		return InfDuration
+	}
+	delay := r.timeToAct.Sub(t)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Cancel indicates that the reservation holder will not use the reserved permits,
+// the permits are given back to the limiter as much as possible.
+// It does nothing once the permits are allowed to be used.
+func (r *Reservation) Cancel() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ok || r.canceled || r.cancel == nil || !time.Now().Before(r.timeToAct) {
+		return
+	}
+	r.canceled = true
+	err := r.cancel(context.Background())
+	if err != nil {
+		slog.Error("cancel reservation:%v", err)
+	}
+}
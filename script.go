@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	slog "github.com/vearne/simplelog"
+)
+
+// LoadScript makes sure the script of alg is cached by redis, and returns its SHA1.
+func LoadScript(ctx context.Context, client redis.Cmdable, alg int) (string, error) {
+	script := AlgMap[alg]
+	scriptSHA1 := ScriptSHA1(alg)
+
+	values, err := client.ScriptExists(ctx, scriptSHA1).Result()
+	if err != nil {
+		return "", err
+	}
+	if !values[0] {
+		_, err = client.ScriptLoad(ctx, script).Result()
+		if err != nil {
+			return "", err
+		}
+	}
+	return scriptSHA1, nil
+}
+
+// ScriptMode decides how the scripts are called.
+type ScriptMode int
+
+const (
+	// EvalShaMode calls the scripts cached by redis with EVALSHA, it is the default.
+	EvalShaMode ScriptMode = iota
+	// EvalMode sends the whole script with EVAL every time.
+	EvalMode
+	// FunctionMode calls the functions of the library with FCALL, Redis 7 is required.
+	FunctionMode
+)
+
+/*
+PrepareScript pings redis and loads the script of alg like LoadScript,
+or the whole function library in FunctionMode, nothing is loaded in EvalMode.
+If d tolerates redis errors, the constructors don't fail without redis,
+the circuit breaker of d is tripped instead, and the script is loaded when redis is probed.
+*/
+func PrepareScript(ctx context.Context, client redis.Cmdable, alg int, d *Degradation,
+	mode ScriptMode) (string, error) {
+	_, err := client.Ping(ctx).Result()
+	if err == nil {
+		switch mode {
+		case EvalMode:
+			return ScriptSHA1(alg), nil
+		case FunctionMode:
+			err = LoadLibrary(ctx, client)
+			if err == nil {
+				return ScriptSHA1(alg), nil
+			}
+		default:
+			var scriptSHA1 string
+			scriptSHA1, err = LoadScript(ctx, client, alg)
+			if err == nil {
+				return scriptSHA1, nil
+			}
+		}
+	}
+	if !d.Degraded() {
+		return "", err
+	}
+	slog.Warn("redis is unavailable, degrade:%v", err)
+	if d.Breaker != nil {
+		d.Breaker.Trip()
+	}
+	return ScriptSHA1(alg), nil
+}
+
+// ScriptSHA1 returns the SHA1 of the script of alg, it doesn't need redis.
+func ScriptSHA1(alg int) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(AlgMap[alg])))
+}
+
+// ScriptMode returns how r calls the scripts.
+func (r *BaseRateLimiter) ScriptMode() ScriptMode {
+	switch {
+	case r.UseFunctions:
+		return FunctionMode
+	case r.PureEval:
+		return EvalMode
+	default:
+		return EvalShaMode
+	}
+}
+
+// EvalScript runs the script of r.Alg, see RunScript.
+func (r *BaseRateLimiter) EvalScript(ctx context.Context, keys []string, args ...interface{}) *redis.Cmd {
+	return r.RunScript(ctx, r.Alg, keys, args...)
+}
+
+/*
+RunScript runs the script of alg with r.Backend, or as ScriptMode says if there is no Backend.
+If redis has lost the script, such as after a restart, a failover or SCRIPT FLUSH,
+it is loaded again and the call is retried, so the caller never sees NOSCRIPT.
+The call is traced as a child span of ctx if r.Tracer is set.
+*/
+func (r *BaseRateLimiter) RunScript(ctx context.Context, alg int, keys []string,
+	args ...interface{}) *redis.Cmd {
+	mode := r.ScriptMode().String()
+	if r.Backend != nil {
+		mode = "backend"
+	}
+	ctx, span := r.StartSpan(ctx, "ratelimit.script", AttrScript.String(AlgName(alg)), AttrScriptMode.String(mode))
+	cmd := r.runScript(ctx, alg, keys, args...)
+	err := cmd.Err()
+	if err == redis.Nil {
+		err = nil
+	}
+	EndSpan(span, Decision{Allowed: err == nil}, err)
+	return cmd
+}
+
+func (r *BaseRateLimiter) runScript(ctx context.Context, alg int, keys []string,
+	args ...interface{}) *redis.Cmd {
+	if r.Backend != nil {
+		cmd := redis.NewCmd(ctx)
+		x, err := r.Backend.Run(ctx, alg, keys, args...)
+		cmd.SetVal(x)
+		cmd.SetErr(err)
+		return cmd
+	}
+	scriptSHA1 := r.ScriptSHA1
+	if alg != r.Alg || scriptSHA1 == "" {
+		scriptSHA1 = ScriptSHA1(alg)
+	}
+	return runRedisScript(ctx, r.RedisClient, r.ScriptMode(), scriptSHA1, alg, keys, args...)
+}
@@ -0,0 +1,140 @@
+package slidinglog
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"log"
+	"testing"
+	"time"
+)
+
+const (
+	key     = "key:log"
+	hashVal = "794b175ebc3fe9e5dd192a1de61a0a1c488bf052"
+)
+
+func MyMatch(expected, actual []interface{}) error {
+	expectedStr := fmt.Sprintf("%v", expected)
+	actualStr := fmt.Sprintf("%v", actual)
+	if expectedStr == actualStr {
+		return nil
+	}
+	log.Printf("expectedStr:%v, actualStr:%v", expectedStr, actualStr)
+	return fmt.Errorf("not equal, expectedStr:%s, actualStr:%s", expectedStr, actualStr)
+}
+
+func TestTakeDecision(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{false})
+	mock.ExpectScriptLoad(ratelimit.AlgMap[ratelimit.SlidingLogAlg]).SetVal(hashVal)
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2).
+		SetVal([]interface{}{int64(2), int64(1), int64(0), int64(1000000)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2).
+		SetVal([]interface{}{int64(0), int64(1), int64(700000), int64(900000)})
+
+	limiter, err := NewSlidingLogLimiter(context.Background(), db, key, time.Second,
+		3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+	assert.Equal(t, 3, d.Limit)
+
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 700*time.Millisecond, d.RetryAfter)
+
+	_, err = ratelimit.TakeN(context.Background(), limiter, 4)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+}
+
+func TestContextTimeOut(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	for i := 0; i < 1000; i++ {
+		mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 1).
+			SetVal([]interface{}{int64(0), int64(0), int64(500000), int64(1000000)})
+	}
+
+	limiter, err := NewSlidingLogLimiter(context.Background(), db, key, time.Second,
+		3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = limiter.Wait(waitCtx)
+	assert.Contains(t, err.Error(), "timeout")
+}
+
+func TestCheckLimit(t *testing.T) {
+	// the error of ratelimit.CheckLimit is returned
+	_, err := NewSlidingLogLimiter(context.Background(), nil, key, time.Microsecond, 10)
+	assert.NotNil(t, err)
+}
+
+// TestScript runs the script on miniredis, whose clock is moved by hand.
+func TestScript(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	start := time.Unix(1700000000, 0)
+	s.SetTime(start.Add(900 * time.Millisecond))
+	limiter, err := NewSlidingLogLimiter(context.Background(), client, key, time.Second,
+		3, WithAntiDDos(false))
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 3)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	// no burst across the boundary of the fixed windows
+	s.SetTime(start.Add(1100 * time.Millisecond))
+	d, err = taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 800*time.Millisecond, d.RetryAfter)
+
+	// the permits slide out of the window one duration after they are taken
+	s.SetTime(start.Add(1900 * time.Millisecond))
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+
+	s.SetTime(start.Add(2400 * time.Millisecond))
+	d, err = taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	// both permits taken at 1.9s must slide out
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter)
+}
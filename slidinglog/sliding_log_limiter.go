@@ -0,0 +1,164 @@
+package slidinglog
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+	"github.com/vearne/ratelimit/internal/window"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+/*
+SlidingLogLimiter records every permit in a sorted set of redis,
+at most throughput permits are allowed in any duration.
+It is exact, but the memory of a key grows with throughput.
+ResetAt of the decisions is the time when all the permits slide out of the window.
+*/
+type SlidingLogLimiter struct {
+	window.Limiter
+
+	options window.Options
+}
+
+type Option func(*SlidingLogLimiter)
+
+func NewSlidingLogLimiter(ctx context.Context, client redis.Cmdable, key string, duration time.Duration,
+	throughput int, opts ...Option) (ratelimit.Limiter, error) {
+
+	newLimiter, err := prepare(ctx, client, duration, throughput, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newLimiter(key), nil
+}
+
+/*
+NewKeyedSlidingLogLimiter creates a limiter which limits every key separately,
+the key in redis is keyPrefix + key, and at most maxKeys limiters are kept in memory.
+*/
+func NewKeyedSlidingLogLimiter(ctx context.Context, client redis.Cmdable, keyPrefix string,
+	duration time.Duration, throughput int,
+	maxKeys int, opts ...Option) (*ratelimit.KeyedLimiter, error) {
+
+	if maxKeys <= 0 {
+		return nil, errors.New("maxKeys must greater than 0")
+	}
+
+	newLimiter, err := prepare(ctx, client, duration, throughput, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ratelimit.NewKeyedLimiter(maxKeys, func(key string) ratelimit.Limiter {
+		return newLimiter(keyPrefix + key)
+	})
+}
+
+// check the arguments and load the script once, then limiters of different keys can be created cheaply
+func prepare(ctx context.Context, client redis.Cmdable, duration time.Duration,
+	throughput int, opts ...Option) (func(key string) *SlidingLogLimiter, error) {
+
+	// the options which are needed before the limiters are created
+	var preset SlidingLogLimiter
+	for _, opt := range opts {
+		opt(&preset)
+	}
+	setup, err := window.Prepare(ctx, client, ratelimit.SlidingLogAlg, duration, throughput,
+		&preset.Limiter, preset.options)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(key string) *SlidingLogLimiter {
+		var r SlidingLogLimiter
+		r.AntiDDoS = true
+
+		// Loop through each option
+		for _, opt := range opts {
+			// Call the option giving the instantiated
+			opt(&r)
+		}
+
+		setup(&r.Limiter, key, r.options)
+		return &r
+	}, nil
+}
+
+func WithAntiDDos(antiDDoS bool) Option {
+	return func(r *SlidingLogLimiter) {
+		r.AntiDDoS = antiDDoS
+	}
+}
+
+// WithAntiDDoSMultiplier sets how many times the throughput the local anti-DDoS limiter allows, 2 by default.
+func WithAntiDDoSMultiplier(multiplier float64) Option {
+	return func(r *SlidingLogLimiter) {
+		r.options.AntiDDoSMultiplier = multiplier
+	}
+}
+
+// WithAntiDDoSBurst sets how many requests the local anti-DDoS limiter allows at once.
+func WithAntiDDoSBurst(burst int) Option {
+	return func(r *SlidingLogLimiter) {
+		r.options.AntiDDoSBurst = burst
+	}
+}
+
+// WithAntiDDoSLimiter replaces the local anti-DDoS limiter, it is shared by all the keys of a keyed limiter.
+func WithAntiDDoSLimiter(limiter *rate.Limiter) Option {
+	return func(r *SlidingLogLimiter) {
+		r.AntiDDoS = true
+		r.options.AntiDDoSLimiter = limiter
+	}
+}
+
+// WithDegradation decides what to do when redis is unavailable, the errors are returned by default.
+func WithDegradation(d ratelimit.Degradation) Option {
+	return func(r *SlidingLogLimiter) {
+		r.options.Degradation = &d
+	}
+}
+
+// WithName sets the name of the limiter which is given to the Observer.
+func WithName(name string) Option {
+	return func(r *SlidingLogLimiter) {
+		r.Name = name
+	}
+}
+
+// WithObserver sets the Observer which is notified of the decisions, the requests to redis, the errors and the waits.
+func WithObserver(observer ratelimit.Observer) Option {
+	return func(r *SlidingLogLimiter) {
+		r.Observer = observer
+	}
+}
+
+// WithTracer traces Take, Wait and the scripts with tracer, such as the one of the module ratelimit/otel.
+func WithTracer(tracer ratelimit.Tracer) Option {
+	return func(r *SlidingLogLimiter) {
+		r.Tracer = tracer
+	}
+}
+
+// WithPureEval sends the whole script with EVAL every time, for the redis ACLs which block SCRIPT commands.
+func WithPureEval(pureEval bool) Option {
+	return func(r *SlidingLogLimiter) {
+		r.PureEval = pureEval
+	}
+}
+
+// WithFunctions calls the functions of the library loaded by FUNCTION LOAD REPLACE instead of the scripts,
+// Redis 7 is required.
+func WithFunctions(useFunctions bool) Option {
+	return func(r *SlidingLogLimiter) {
+		r.UseFunctions = useFunctions
+	}
+}
+
+// WithBackend runs the scripts with backend instead of the redis client, which may be nil then.
+func WithBackend(backend ratelimit.Backend) Option {
+	return func(r *SlidingLogLimiter) {
+		r.Backend = backend
+	}
+}
@@ -0,0 +1,141 @@
+package slidingwindow
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"log"
+	"testing"
+	"time"
+)
+
+const (
+	key     = "key:window"
+	hashVal = "c8f454e68d2fb88e205d387c9000f3783435c911"
+)
+
+func MyMatch(expected, actual []interface{}) error {
+	expectedStr := fmt.Sprintf("%v", expected)
+	actualStr := fmt.Sprintf("%v", actual)
+	if expectedStr == actualStr {
+		return nil
+	}
+	log.Printf("expectedStr:%v, actualStr:%v", expectedStr, actualStr)
+	return fmt.Errorf("not equal, expectedStr:%s, actualStr:%s", expectedStr, actualStr)
+}
+
+func TestTakeDecision(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{false})
+	mock.ExpectScriptLoad(ratelimit.AlgMap[ratelimit.SlidingWindowAlg]).SetVal(hashVal)
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2).
+		SetVal([]interface{}{int64(2), int64(1), int64(0), int64(1000000)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 2).
+		SetVal([]interface{}{int64(0), int64(1), int64(700000), int64(900000)})
+
+	limiter, err := NewSlidingWindowLimiter(context.Background(), db, key, time.Second,
+		3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+	assert.Equal(t, 3, d.Limit)
+
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 700*time.Millisecond, d.RetryAfter)
+
+	_, err = ratelimit.TakeN(context.Background(), limiter, 4)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+}
+
+func TestContextTimeOut(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	for i := 0; i < 1000; i++ {
+		mock.ExpectEvalSha(hashVal, []string{key}, 1000000, 3, 1).
+			SetVal([]interface{}{int64(0), int64(0), int64(500000), int64(1000000)})
+	}
+
+	limiter, err := NewSlidingWindowLimiter(context.Background(), db, key, time.Second,
+		3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = limiter.Wait(waitCtx)
+	assert.Contains(t, err.Error(), "timeout")
+}
+
+func TestCheckLimit(t *testing.T) {
+	// the error of ratelimit.CheckLimit is returned
+	_, err := NewSlidingWindowLimiter(context.Background(), nil, key, time.Microsecond, 10)
+	assert.NotNil(t, err)
+}
+
+// TestScript runs the script on miniredis, whose clock is moved by hand.
+func TestScript(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	start := time.Unix(1700000000, 0)
+	s.SetTime(start.Add(900 * time.Millisecond))
+	limiter, err := NewSlidingWindowLimiter(context.Background(), client, key, time.Second,
+		10, WithAntiDDos(false))
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 10)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	// the previous window weighs 0.9, so only 1 permit is left across the boundary
+	s.SetTime(start.Add(1100 * time.Millisecond))
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+	assert.Equal(t, 100*time.Millisecond, d.RetryAfter)
+
+	d, err = taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	// the previous window weighs 0.5, 10*0.5 + 1 permits are estimated
+	s.SetTime(start.Add(1500 * time.Millisecond))
+	d, err = taker.TakeDecision(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	// 5 + 6 permits exceed a window, wait until the 5 weigh 0.8 in the next window
+	s.SetTime(start.Add(1900 * time.Millisecond))
+	d, err = taker.TakeDecision(context.Background(), 6)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 300*time.Millisecond, d.RetryAfter)
+}
@@ -0,0 +1,165 @@
+package slidingwindow
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+	"github.com/vearne/ratelimit/internal/window"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+/*
+SlidingWindowLimiter counts the permits of every window like the counter algorithm,
+the number of permits in the sliding window is estimated by the previous window
+weighted by the part of it still in the sliding window, plus the current window.
+So it doesn't allow 2x throughput across the window boundary, and only 2 keys are used.
+ResetAt of the decisions is the time when the estimated number of permits becomes 0.
+*/
+type SlidingWindowLimiter struct {
+	window.Limiter
+
+	options window.Options
+}
+
+type Option func(*SlidingWindowLimiter)
+
+func NewSlidingWindowLimiter(ctx context.Context, client redis.Cmdable, key string, duration time.Duration,
+	throughput int, opts ...Option) (ratelimit.Limiter, error) {
+
+	newLimiter, err := prepare(ctx, client, duration, throughput, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newLimiter(key), nil
+}
+
+/*
+NewKeyedSlidingWindowLimiter creates a limiter which limits every key separately,
+the key in redis is keyPrefix + key, and at most maxKeys limiters are kept in memory.
+*/
+func NewKeyedSlidingWindowLimiter(ctx context.Context, client redis.Cmdable, keyPrefix string,
+	duration time.Duration, throughput int,
+	maxKeys int, opts ...Option) (*ratelimit.KeyedLimiter, error) {
+
+	if maxKeys <= 0 {
+		return nil, errors.New("maxKeys must greater than 0")
+	}
+
+	newLimiter, err := prepare(ctx, client, duration, throughput, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ratelimit.NewKeyedLimiter(maxKeys, func(key string) ratelimit.Limiter {
+		return newLimiter(keyPrefix + key)
+	})
+}
+
+// check the arguments and load the script once, then limiters of different keys can be created cheaply
+func prepare(ctx context.Context, client redis.Cmdable, duration time.Duration,
+	throughput int, opts ...Option) (func(key string) *SlidingWindowLimiter, error) {
+
+	// the options which are needed before the limiters are created
+	var preset SlidingWindowLimiter
+	for _, opt := range opts {
+		opt(&preset)
+	}
+	setup, err := window.Prepare(ctx, client, ratelimit.SlidingWindowAlg, duration, throughput,
+		&preset.Limiter, preset.options)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(key string) *SlidingWindowLimiter {
+		var r SlidingWindowLimiter
+		r.AntiDDoS = true
+
+		// Loop through each option
+		for _, opt := range opts {
+			// Call the option giving the instantiated
+			opt(&r)
+		}
+
+		setup(&r.Limiter, key, r.options)
+		return &r
+	}, nil
+}
+
+func WithAntiDDos(antiDDoS bool) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.AntiDDoS = antiDDoS
+	}
+}
+
+// WithAntiDDoSMultiplier sets how many times the throughput the local anti-DDoS limiter allows, 2 by default.
+func WithAntiDDoSMultiplier(multiplier float64) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.options.AntiDDoSMultiplier = multiplier
+	}
+}
+
+// WithAntiDDoSBurst sets how many requests the local anti-DDoS limiter allows at once.
+func WithAntiDDoSBurst(burst int) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.options.AntiDDoSBurst = burst
+	}
+}
+
+// WithAntiDDoSLimiter replaces the local anti-DDoS limiter, it is shared by all the keys of a keyed limiter.
+func WithAntiDDoSLimiter(limiter *rate.Limiter) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.AntiDDoS = true
+		r.options.AntiDDoSLimiter = limiter
+	}
+}
+
+// WithDegradation decides what to do when redis is unavailable, the errors are returned by default.
+func WithDegradation(d ratelimit.Degradation) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.options.Degradation = &d
+	}
+}
+
+// WithName sets the name of the limiter which is given to the Observer.
+func WithName(name string) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.Name = name
+	}
+}
+
+// WithObserver sets the Observer which is notified of the decisions, the requests to redis, the errors and the waits.
+func WithObserver(observer ratelimit.Observer) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.Observer = observer
+	}
+}
+
+// WithTracer traces Take, Wait and the scripts with tracer, such as the one of the module ratelimit/otel.
+func WithTracer(tracer ratelimit.Tracer) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.Tracer = tracer
+	}
+}
+
+// WithPureEval sends the whole script with EVAL every time, for the redis ACLs which block SCRIPT commands.
+func WithPureEval(pureEval bool) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.PureEval = pureEval
+	}
+}
+
+// WithFunctions calls the functions of the library loaded by FUNCTION LOAD REPLACE instead of the scripts,
+// Redis 7 is required.
+func WithFunctions(useFunctions bool) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.UseFunctions = useFunctions
+	}
+}
+
+// WithBackend runs the scripts with backend instead of the redis client, which may be nil then.
+func WithBackend(backend ratelimit.Backend) Option {
+	return func(r *SlidingWindowLimiter) {
+		r.Backend = backend
+	}
+}
@@ -0,0 +1,34 @@
+package timewindow
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+	"time"
+)
+
+// DefaultWindowBuckets is the number of buckets of the limiters created by ratelimit.New.
+const DefaultWindowBuckets = 10
+
+func init() {
+	ratelimit.Register("time_window", newFromConfig)
+}
+
+// newFromConfig creates the limiter of ratelimit.New, it is local, client and the key are not used.
+func newFromConfig(ctx context.Context, client redis.Cmdable, cfg ratelimit.Config,
+	rate ratelimit.Rate) (ratelimit.Limiter, error) {
+	if cfg.Burst != 0 {
+		return nil, ratelimit.NewConfigError("burst", "it is not supported by time_window")
+	}
+	if cfg.Batch != 0 {
+		return nil, ratelimit.NewConfigError("batch", "it is not supported by time_window")
+	}
+	buckets := cfg.Buckets
+	if buckets == 0 {
+		buckets = DefaultWindowBuckets
+	}
+	if rate.Per/time.Duration(buckets) <= 0 {
+		return nil, ratelimit.NewConfigError("buckets", "%d is too many for the period %v", buckets, rate.Per)
+	}
+	return NewSlideTimeWindowLimiter(rate.Count, rate.Per, buckets, WithName(cfg.Name))
+}
@@ -0,0 +1,261 @@
+package timewindow
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTakeN(t *testing.T) {
+	limiter, err := NewSlideTimeWindowLimiter(5, time.Second, 10)
+	assert.Nil(t, err)
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 3)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = ratelimit.TakeN(context.Background(), limiter, 3)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = ratelimit.TakeN(context.Background(), limiter, 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = ratelimit.TakeN(context.Background(), limiter, 6)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+}
+
+func TestReserve(t *testing.T) {
+	limiter, err := NewSlideTimeWindowLimiter(4, time.Second, 10)
+	assert.Nil(t, err)
+	reserver := limiter.(ratelimit.Reserver)
+
+	r, err := reserver.Reserve(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.Equal(t, time.Duration(0), r.Delay())
+
+	// the tokens slide out of the window in one second
+	r, err = reserver.Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.True(t, r.Delay() > 800*time.Millisecond && r.Delay() <= time.Second)
+
+	// the reserved tokens are counted as used
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	r.Cancel()
+	r, err = reserver.Reserve(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.True(t, r.Delay() > 800*time.Millisecond && r.Delay() <= time.Second)
+
+	r, err = reserver.Reserve(context.Background(), 5)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+}
+
+func TestTakeDecision(t *testing.T) {
+	limiter, err := NewSlideTimeWindowLimiter(4, time.Second, 10)
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 3)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+	assert.Equal(t, 4, d.Limit)
+	assert.True(t, time.Until(d.ResetAt) > 800*time.Millisecond && time.Until(d.ResetAt) <= time.Second)
+
+	d, err = taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 1, d.Remaining)
+	assert.True(t, d.RetryAfter > 800*time.Millisecond && d.RetryAfter <= time.Second)
+}
+
+func TestKeyed(t *testing.T) {
+	limiter, err := NewKeyedSlideTimeWindowLimiter(1, time.Second, 10, 2)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"a", "b"} {
+		ok, err := limiter.Take(context.Background(), key)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	ok, err := limiter.Take(context.Background(), "a")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// "b" is the least recently used one
+	ok, err = limiter.Take(context.Background(), "c")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, limiter.Len())
+	ok, err = limiter.Take(context.Background(), "b")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = NewKeyedSlideTimeWindowLimiter(1, time.Second, 10, 0)
+	assert.NotNil(t, err)
+}
+
+func TestInvalidArgs(t *testing.T) {
+	cases := []struct {
+		throughput    int
+		duration      time.Duration
+		windowBuckets int
+	}{
+		{0, time.Second, 10},
+		{10, time.Microsecond, 10},
+		{10, time.Second, 0},
+		{10, time.Millisecond, 2000000},
+	}
+	for _, c := range cases {
+		_, err := NewSlideTimeWindowLimiter(c.throughput, c.duration, c.windowBuckets)
+		assert.NotNil(t, err)
+		_, err = NewKeyedSlideTimeWindowLimiter(c.throughput, c.duration, c.windowBuckets, 2)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestSubSecond(t *testing.T) {
+	// 50 per 250ms
+	limiter, _ := NewSlideTimeWindowLimiter(50, 250*time.Millisecond, 5)
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 50)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = limiter.Take(context.Background())
+	assert.False(t, ok)
+
+	time.Sleep(300 * time.Millisecond)
+	ok, _ = limiter.Take(context.Background())
+	assert.True(t, ok)
+}
+
+func TestNew(t *testing.T) {
+	limiter, err := ratelimit.New(context.Background(), nil, ratelimit.Config{
+		Algorithm: "time_window",
+		Rate:      "2/s",
+		Name:      "api",
+	})
+	assert.Nil(t, err)
+	assert.IsType(t, &SlideTimeWindowLimiter{}, limiter)
+	assert.Equal(t, "api", limiter.(*SlideTimeWindowLimiter).name)
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = ratelimit.TakeN(context.Background(), limiter, 1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	cases := []struct {
+		cfg   ratelimit.Config
+		field string
+	}{
+		{ratelimit.Config{Rate: "2/s"}, "algorithm"},
+		{ratelimit.Config{Algorithm: "unknown", Rate: "2/s"}, "algorithm"},
+		{ratelimit.Config{Algorithm: "gcra", Rate: "2/s"}, "algorithm"},
+		{ratelimit.Config{Algorithm: "time_window"}, "rate"},
+		{ratelimit.Config{Algorithm: "time_window", Rate: "2"}, "rate"},
+		{ratelimit.Config{Algorithm: "time_window", Rate: "0/s"}, "rate"},
+		{ratelimit.Config{Algorithm: "time_window", Rate: "2/week"}, "rate"},
+		{ratelimit.Config{Algorithm: "time_window", Rate: "2/100us"}, "rate"},
+		{ratelimit.Config{Algorithm: "time_window", Rate: "2/s", Burst: 5}, "burst"},
+		{ratelimit.Config{Algorithm: "time_window", Rate: "2/s", Batch: -1}, "batch"},
+	}
+	for _, c := range cases {
+		_, err = ratelimit.New(context.Background(), nil, c.cfg)
+		var configErr *ratelimit.ConfigError
+		if assert.ErrorAs(t, err, &configErr, "%+v", c.cfg) {
+			assert.Equal(t, c.field, configErr.Field, "%+v", c.cfg)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]ratelimit.Rate{
+		"200/s":      {Count: 200, Per: time.Second},
+		"5000/1h":    {Count: 5000, Per: time.Hour},
+		"10/100ms":   {Count: 10, Per: 100 * time.Millisecond},
+		"100/minute": {Count: 100, Per: time.Minute},
+		" 7 / 2d ":   {Count: 7, Per: 48 * time.Hour},
+		"3/1.5s":     {Count: 3, Per: 1500 * time.Millisecond},
+	}
+	for s, expected := range cases {
+		r, err := ratelimit.ParseRate(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, r, s)
+	}
+
+	for _, s := range []string{"", "200", "a/s", "-1/s", "1/", "1/0s", "1/x"} {
+		_, err := ratelimit.ParseRate(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+// recorder keeps the events it is notified of
+type recorder struct {
+	ratelimit.NopObserver
+	mu        sync.Mutex
+	infos     []ratelimit.ObserverInfo
+	decisions []ratelimit.DecisionEvent
+	errs      []error
+	waits     []ratelimit.WaitEvent
+}
+
+func (o *recorder) OnDecision(info ratelimit.ObserverInfo, e ratelimit.DecisionEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.infos = append(o.infos, info)
+	o.decisions = append(o.decisions, e)
+}
+
+func (o *recorder) OnError(info ratelimit.ObserverInfo, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.errs = append(o.errs, err)
+}
+
+func (o *recorder) OnWait(info ratelimit.ObserverInfo, e ratelimit.WaitEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.waits = append(o.waits, e)
+}
+
+func TestObserver(t *testing.T) {
+	o := &recorder{}
+	limiter, err := NewSlideTimeWindowLimiter(2, time.Second, 10, WithName("api"), WithObserver(o))
+	assert.Nil(t, err)
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = ratelimit.TakeN(context.Background(), limiter, 3)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+
+	// the deadline is before the next permit
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, limiter.Wait(ctx))
+
+	assert.Equal(t, ratelimit.ObserverInfo{Name: "api", Algorithm: "time_window"}, o.infos[0])
+	if assert.Len(t, o.decisions, 2) {
+		assert.True(t, o.decisions[0].Decision.Allowed)
+		assert.True(t, o.decisions[0].Local)
+		assert.Equal(t, 2, o.decisions[0].N)
+		assert.Equal(t, ratelimit.ReasonQuotaExhausted, o.decisions[1].Decision.Reason)
+	}
+	assert.Equal(t, []error{ratelimit.ErrExceedsLimit}, o.errs)
+	if assert.Len(t, o.waits, 1) {
+		assert.NotNil(t, o.waits[0].Err)
+	}
+}
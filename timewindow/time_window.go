@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/vearne/ratelimit"
 	slog "github.com/vearne/simplelog"
+	"sort"
 	"sync"
 	"time"
 )
@@ -23,9 +24,31 @@ type SlideTimeWindowLimiter struct {
 	durationPerBucket time.Duration
 	lastUpdateTime    time.Time
 	buckets           []int
+
+	// the permits reserved for the future, they are counted as used until they expire
+	pending []*pendingReservation
+
+	closed bool
+
+	// name and observer are set by WithName and WithObserver
+	name     string
+	observer ratelimit.Observer
+}
+
+type Option func(*SlideTimeWindowLimiter)
+
+type pendingReservation struct {
+	n         int
+	timeToAct time.Time
 }
 
-func NewSlideTimeWindowLimiter(throughput int, duration time.Duration, windowBuckets int) (ratelimit.Limiter, error) {
+func NewSlideTimeWindowLimiter(throughput int, duration time.Duration, windowBuckets int,
+	opts ...Option) (ratelimit.Limiter, error) {
+	err := checkArgs(throughput, duration, windowBuckets)
+	if err != nil {
+		return nil, err
+	}
+
 	s := SlideTimeWindowLimiter{buckets: make([]int, windowBuckets)}
 	s.throughput = throughput
 	s.durationPerBucket = duration / time.Duration(windowBuckets)
@@ -36,12 +59,77 @@ func NewSlideTimeWindowLimiter(throughput int, duration time.Duration, windowBuc
 	for i := 0; i < windowBuckets; i++ {
 		s.buckets[i] = 0
 	}
+	for _, opt := range opts {
+		opt(&s)
+	}
 	return &s, nil
 }
 
+// checkArgs checks throughput per duration like the other limiters, and that every bucket is at least 1ns.
+func checkArgs(throughput int, duration time.Duration, windowBuckets int) error {
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return err
+	}
+
+	if windowBuckets <= 0 {
+		return errors.New("windowBuckets must greater than 0")
+	}
+
+	if duration/time.Duration(windowBuckets) == 0 {
+		return errors.New("windowBuckets is too large for the duration")
+	}
+	return nil
+}
+
+/*
+NewKeyedSlideTimeWindowLimiter creates a limiter which limits every key separately,
+at most maxKeys limiters are kept in memory, the state of an evicted key is lost.
+*/
+func NewKeyedSlideTimeWindowLimiter(throughput int, duration time.Duration, windowBuckets int,
+	maxKeys int, opts ...Option) (*ratelimit.KeyedLimiter, error) {
+	if maxKeys <= 0 {
+		return nil, errors.New("maxKeys must greater than 0")
+	}
+	err := checkArgs(throughput, duration, windowBuckets)
+	if err != nil {
+		return nil, err
+	}
+	return ratelimit.NewKeyedLimiter(maxKeys, func(key string) ratelimit.Limiter {
+		s, _ := NewSlideTimeWindowLimiter(throughput, duration, windowBuckets, opts...)
+		return s
+	})
+}
+
+// WithName sets the name of the limiter which is given to the Observer.
+func WithName(name string) Option {
+	return func(s *SlideTimeWindowLimiter) {
+		s.name = name
+	}
+}
+
+/*
+WithObserver sets the Observer which is notified of the decisions, the errors and the waits,
+the decisions are local, and there is no request to redis to be notified of.
+*/
+func WithObserver(observer ratelimit.Observer) Option {
+	return func(s *SlideTimeWindowLimiter) {
+		s.observer = observer
+	}
+}
+
 // wait until take a token or timeout
 func (r *SlideTimeWindowLimiter) Wait(ctx context.Context) (err error) {
-	ok, err := r.Take(ctx)
+	return r.WaitN(ctx, 1)
+}
+
+// wait until take n tokens at once or timeout
+func (r *SlideTimeWindowLimiter) WaitN(ctx context.Context, n int) (err error) {
+	start := time.Now()
+	defer func() {
+		r.observeWait(n, start, err)
+	}()
+	ok, err := r.TakeN(ctx, n)
 	slog.Debug("r.Take")
 	if err != nil {
 		return err
@@ -56,7 +144,7 @@ func (r *SlideTimeWindowLimiter) Wait(ctx context.Context) (err error) {
 	if ok {
 		if deadline.Before(time.Now().Add(minWaitTime)) {
 			slog.Debug("can't get token before %v", deadline)
-			return fmt.Errorf("can't get token before %v", deadline)
+			return fmt.Errorf("%w %v", ratelimit.ErrDeadline, deadline)
 		}
 	}
 
@@ -67,7 +155,7 @@ func (r *SlideTimeWindowLimiter) Wait(ctx context.Context) (err error) {
 		case <-ctx.Done():
 			return errors.New("context timeout")
 		case <-timer.C:
-			ok, err := r.Take(ctx)
+			ok, err := r.TakeN(ctx, n)
 			if err != nil {
 				return err
 			}
@@ -79,29 +167,192 @@ func (r *SlideTimeWindowLimiter) Wait(ctx context.Context) (err error) {
 }
 
 func (s *SlideTimeWindowLimiter) Take(ctx context.Context) (bool, error) {
+	return s.TakeN(ctx, 1)
+}
+
+// TakeN takes n tokens at once, either all of them or none.
+// n can't be greater than throughput, otherwise ratelimit.ErrExceedsLimit is returned.
+func (s *SlideTimeWindowLimiter) TakeN(ctx context.Context, n int) (bool, error) {
+	d, err := s.TakeDecision(ctx, n)
+	return d.Allowed, err
+}
+
+// TakeDecision works like TakeN, ResetAt is the time when all the used tokens slide out of the window.
+func (s *SlideTimeWindowLimiter) TakeDecision(ctx context.Context, n int) (d ratelimit.Decision, err error) {
+	defer func() {
+		s.observeDecision(n, d, err)
+	}()
+	if n <= 0 {
+		return ratelimit.Decision{}, ratelimit.ErrInvalidN
+	}
+	if n > s.throughput {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ratelimit.Decision{}, ratelimit.ErrClosed
+	}
+
+	nowTime := time.Now()
+	s.advance(nowTime)
+	d = ratelimit.Decision{Allowed: s.throughput-s.used() >= n, Limit: s.throughput}
+	if d.Allowed {
+		s.buckets[s.bucketIndex(nowTime)] += n
+	} else {
+		d.RetryAfter = s.freeAt(n).Sub(nowTime)
+		d.Reason = ratelimit.ReasonQuotaExhausted
+	}
+	d.Remaining = s.throughput - s.used()
+	d.ResetAt = s.freeAt(s.throughput)
+	return d, nil
+}
+
+/*
+Reserve reserves n tokens, they can be used when enough tokens slide out of the window.
+The reservation is not OK if n is greater than throughput.
+*/
+func (s *SlideTimeWindowLimiter) Reserve(ctx context.Context, n int) (*ratelimit.Reservation, error) {
+	if n <= 0 {
+		return nil, ratelimit.ErrInvalidN
+	}
+	if n > s.throughput {
+		return ratelimit.NewReservation(false, 0, nil), nil
+	}
+
 	s.Lock()
 	defer s.Unlock()
+	if s.closed {
+		return nil, ratelimit.ErrClosed
+	}
 
 	nowTime := time.Now()
-	lastBucketIndex := int(s.lastUpdateTime.UnixNano()/int64(s.durationPerBucket)) % s.windowBuckets
-	nowBucketIndex := int(nowTime.UnixNano()/int64(s.durationPerBucket)) % s.windowBuckets
+	s.advance(nowTime)
+	if s.throughput-s.used() >= n {
+		s.buckets[s.bucketIndex(nowTime)] += n
+		return ratelimit.NewReservation(true, 0, nil), nil
+	}
+
+	p := &pendingReservation{n: n, timeToAct: s.freeAt(n)}
+	s.pending = append(s.pending, p)
+	return ratelimit.NewReservation(true, p.timeToAct.Sub(nowTime), func(ctx context.Context) error {
+		s.Lock()
+		defer s.Unlock()
+		for i, item := range s.pending {
+			if item == p {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}), nil
+}
+
+// Close marks the limiter closed, nothing is kept out of memory, so there is nothing to give back.
+func (s *SlideTimeWindowLimiter) Close(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *SlideTimeWindowLimiter) observerInfo() ratelimit.ObserverInfo {
+	return ratelimit.ObserverInfo{Name: s.name, Algorithm: "time_window"}
+}
+
+func (s *SlideTimeWindowLimiter) observeDecision(n int, d ratelimit.Decision, err error) {
+	if s.observer == nil {
+		return
+	}
+	if err != nil {
+		s.observer.OnError(s.observerInfo(), err)
+		return
+	}
+	s.observer.OnDecision(s.observerInfo(), ratelimit.DecisionEvent{N: n, Decision: d, Local: true})
+}
 
-	if nowTime.Sub(s.lastUpdateTime) > s.durationPerBucket*time.Duration(s.windowBuckets-1) {
+func (s *SlideTimeWindowLimiter) observeWait(n int, start time.Time, err error) {
+	if s.observer == nil {
+		return
+	}
+	s.observer.OnWait(s.observerInfo(), ratelimit.WaitEvent{N: n, Waited: time.Since(start), Err: err})
+}
+
+func (s *SlideTimeWindowLimiter) bucketNumber(t time.Time) int64 {
+	return t.UnixNano() / int64(s.durationPerBucket)
+}
+
+func (s *SlideTimeWindowLimiter) bucketIndex(t time.Time) int {
+	return int(s.bucketNumber(t) % int64(s.windowBuckets))
+}
+
+// slide the window to nowTime, and move the reservations which are due into it
+func (s *SlideTimeWindowLimiter) advance(nowTime time.Time) {
+	lastBucket := s.bucketNumber(s.lastUpdateTime)
+	nowBucket := s.bucketNumber(nowTime)
+	if nowBucket-lastBucket >= int64(s.windowBuckets) {
 		for i := 0; i < s.windowBuckets; i++ {
 			s.buckets[i] = 0
 		}
-	} else if nowBucketIndex != lastBucketIndex {
-		for i := (lastBucketIndex + 1) % s.windowBuckets; i != nowBucketIndex; i = (i + 1) % s.windowBuckets {
-			s.buckets[i] = 0
+	} else {
+		for b := lastBucket + 1; b <= nowBucket; b++ {
+			s.buckets[b%int64(s.windowBuckets)] = 0
 		}
 	}
-	if s.throughput-s.Count() > 0 {
-		s.buckets[nowBucketIndex]++
-		s.lastUpdateTime = time.Now()
-		return true, nil
-	} else {
-		return false, nil
+	s.lastUpdateTime = nowTime
+
+	pending := s.pending[:0]
+	for _, p := range s.pending {
+		if p.timeToAct.After(nowTime) {
+			pending = append(pending, p)
+		} else {
+			s.buckets[s.bucketIndex(nowTime)] += p.n
+		}
+	}
+	s.pending = pending
+}
+
+func (s *SlideTimeWindowLimiter) used() int {
+	total := s.Count()
+	for _, p := range s.pending {
+		total += p.n
+	}
+	return total
+}
+
+// the earliest time when n tokens are free
+func (s *SlideTimeWindowLimiter) freeAt(n int) time.Time {
+	type expiration struct {
+		bucket int64
+		n      int
+	}
+	// a bucket slides out of the window windowBuckets buckets later
+	expirations := make([]expiration, 0, s.windowBuckets+len(s.pending))
+	nowBucket := s.bucketNumber(s.lastUpdateTime)
+	for b := nowBucket - int64(s.windowBuckets) + 1; b <= nowBucket; b++ {
+		expirations = append(expirations, expiration{b + int64(s.windowBuckets),
+			s.buckets[b%int64(s.windowBuckets)]})
+	}
+	for _, p := range s.pending {
+		expirations = append(expirations, expiration{s.bucketNumber(p.timeToAct) + int64(s.windowBuckets), p.n})
+	}
+	sort.Slice(expirations, func(i, j int) bool {
+		return expirations[i].bucket < expirations[j].bucket
+	})
+
+	free := s.throughput - s.used()
+	if free >= n {
+		return s.lastUpdateTime
+	}
+	for _, e := range expirations {
+		free += e.n
+		if free >= n {
+			return time.Unix(0, e.bucket*int64(s.durationPerBucket))
+		}
 	}
+	// unreachable, all the tokens are free after the last expiration
+	return time.Unix(0, expirations[len(expirations)-1].bucket*int64(s.durationPerBucket))
 }
 
 func (s *SlideTimeWindowLimiter) Count() int {
@@ -0,0 +1,37 @@
+package tokenbucket
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/vearne/ratelimit"
+)
+
+func init() {
+	ratelimit.Register("token_bucket", newFromConfig)
+}
+
+// newFromConfig creates the limiter of ratelimit.New, the bucket is refilled at Rate and holds Burst tokens.
+func newFromConfig(ctx context.Context, client redis.Cmdable, cfg ratelimit.Config,
+	rate ratelimit.Rate) (ratelimit.Limiter, error) {
+	if cfg.Buckets != 0 {
+		return nil, ratelimit.NewConfigError("buckets", "it is not supported by token_bucket")
+	}
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = rate.Count
+	}
+	if cfg.Local {
+		return NewLocal(rate.Per, rate.Count, burst, WithName(cfg.Name))
+	}
+	if cfg.Key == "" {
+		return nil, ratelimit.NewConfigError("key", "it is required by token_bucket")
+	}
+	batch := cfg.Batch
+	if batch == 0 {
+		batch = 1
+	}
+	if batch > burst {
+		return nil, ratelimit.NewConfigError("batch", "%d is greater than the burst %d", batch, burst)
+	}
+	return NewTokenBucketRateLimiter(ctx, client, cfg.Key, rate.Per, rate.Count, burst, batch, WithName(cfg.Name))
+}
@@ -0,0 +1,23 @@
+package tokenbucket
+
+import (
+	"context"
+	"github.com/vearne/ratelimit"
+	"time"
+)
+
+// localKey is the key of the local limiters, every one of them has a MemoryBackend of its own
+const localKey = "local"
+
+/*
+NewLocal creates a TokenBucketLimiter which works in memory, for a single process,
+the bucket is refilled at throughput per duration up to maxCapacity.
+It runs the script on a ratelimit.MemoryBackend of its own, one token at a time, without the anti-DDoS limiter.
+opts such as WithName and WithObserver work the same as with redis, WithBackend is ignored.
+*/
+func NewLocal(duration time.Duration, throughput int, maxCapacity int, opts ...Option) (ratelimit.Limiter, error) {
+	opts = append([]Option{WithAntiDDos(false)}, opts...)
+	opts = append(opts, WithBackend(ratelimit.NewMemoryBackend()))
+	return NewTokenBucketRateLimiter(context.Background(), nil, localKey, duration, throughput, maxCapacity, 1,
+		opts...)
+}
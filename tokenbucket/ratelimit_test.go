@@ -3,8 +3,11 @@ package tokenbucket
 import (
 	"context"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"github.com/vearne/ratelimit"
 	"log"
 	"testing"
 	"time"
@@ -12,7 +15,7 @@ import (
 
 const (
 	key     = "key:token"
-	hashVal = "1fc288109bccebf36ff083517ed03c4901c80be1"
+	hashVal = "f781b16fdd724702eeb2bbcdeffd346c49f33553"
 )
 
 func MyMatch(expected, actual []interface{}) error {
@@ -32,7 +35,8 @@ func TestTakeFail(t *testing.T) {
 	mock.ExpectPing().SetVal("PONG")
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
-	mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 1).SetVal(int64(0))
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 1, 1).
+		SetVal([]interface{}{int64(0), int64(0), int64(333334), int64(333334), int64(1)})
 
 	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
 		time.Second,
@@ -61,7 +65,8 @@ func TestTakeSuccess(t *testing.T) {
 	mock.ExpectPing().SetVal("PONG")
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
-	mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 1).SetVal(int64(1))
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 1, 1).
+		SetVal([]interface{}{int64(1), int64(0), int64(0), int64(333334), int64(1)})
 
 	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
 		time.Second,
@@ -90,7 +95,8 @@ func TestContextTimeOut(t *testing.T) {
 
 	mock.ExpectScriptExists(hashVal).SetVal([]bool{true, true})
 	for i := 0; i < 1000; i++ {
-		mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 1).SetVal(int64(0))
+		mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 1, 1).
+			SetVal([]interface{}{int64(0), int64(0), int64(333334), int64(333334), int64(1)})
 	}
 
 	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
@@ -108,3 +114,519 @@ func TestContextTimeOut(t *testing.T) {
 	err = limiter.Wait(waitCtx)
 	assert.Contains(t, err.Error(), "timeout")
 }
+
+func TestTakeN(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	// n is greater than batchSize, fetch all of them at once
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 5, 4).
+		SetVal([]interface{}{int64(0), int64(2), int64(666667), int64(1000000), int64(5)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 5, 4).
+		SetVal([]interface{}{int64(4), int64(0), int64(0), int64(1666667), int64(5)})
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		5,
+		2, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := ratelimit.TakeN(context.Background(), limiter, 4)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = ratelimit.TakeN(context.Background(), limiter, 4)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// can never be satisfied
+	err = ratelimit.WaitN(context.Background(), limiter, 6)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+}
+
+func TestReserve(t *testing.T) {
+	reserveHashVal := "d864a84b885ed61305ae19ff42f0dc9c262d8e9f"
+	cancelHashVal := "881910dfb9b94857e765ca2eeb41874ccd66d856"
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(reserveHashVal, []string{key}, 3, 5, 4).
+		SetVal([]interface{}{int64(1000000), int64(1700000001000000)})
+	mock.ExpectEvalSha(cancelHashVal, []string{key}, 3, 5, 4, 1700000001000000).SetVal(int64(4))
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		5,
+		2, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	reserver := limiter.(ratelimit.Reserver)
+
+	r, err := reserver.Reserve(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.True(t, r.Delay() > 900*time.Millisecond && r.Delay() <= time.Second)
+	r.Cancel()
+	// cancel only once
+	r.Cancel()
+
+	r, err = reserver.Reserve(context.Background(), 6)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+}
+
+// TestReserveCancel cancels a reservation whose tokens a later reservation has borrowed,
+// on miniredis whose clock stands still.
+func TestReserveCancel(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+	s.SetTime(time.Unix(1700000000, 0))
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), client, key, time.Second,
+		10, 4, 1, WithAntiDDos(false))
+	assert.Nil(t, err)
+	reserver := limiter.(ratelimit.Reserver)
+
+	r, err := reserver.Reserve(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), r.Delay())
+	first, err := reserver.Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, first.Delay() > 100*time.Millisecond)
+	second, err := reserver.Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, second.Delay() > 300*time.Millisecond)
+	assert.Equal(t, "-4", s.HGet(key, "token_count"))
+
+	// the tokens of first are borrowed by second
+	first.Cancel()
+	assert.Equal(t, "-4", s.HGet(key, "token_count"))
+
+	// the last reservation gives back its tokens
+	second.Cancel()
+	assert.Equal(t, "-2", s.HGet(key, "token_count"))
+}
+
+func TestTakeDecision(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 2, 5, 4).
+		SetVal([]interface{}{int64(0), int64(2), int64(666667), int64(1000000), int64(5)})
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		5,
+		2, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 2, d.Remaining)
+	assert.Equal(t, 5, d.Limit)
+	assert.True(t, time.Until(d.ResetAt) <= time.Second)
+	assert.True(t, d.RetryAfter > 600*time.Millisecond && d.RetryAfter <= 666667*time.Microsecond)
+}
+
+func TestDurations(t *testing.T) {
+	cases := []struct {
+		duration         time.Duration
+		throughput       int
+		throughputPerSec string
+	}{
+		// 50 per 250ms
+		{250 * time.Millisecond, 50, "200"},
+		// 90 per 1.5s
+		{1500 * time.Millisecond, 90, "60"},
+		{time.Millisecond, 1, "1000"},
+		{time.Hour, 36, "0.01"},
+	}
+	for _, c := range cases {
+		db, mock := redismock.NewClientMock()
+
+		mock = mock.CustomMatch(MyMatch)
+		mock.ExpectPing().SetVal("PONG")
+		mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+		mock.ExpectEvalSha(hashVal, []string{key}, c.throughputPerSec, 1, c.throughput, 1).
+			SetVal([]interface{}{int64(1), int64(c.throughput - 1), int64(0), int64(1000), int64(c.throughput)})
+
+		// the anti DDoS limiter works with any duration
+		limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key, c.duration,
+			c.throughput,
+			c.throughput,
+			1)
+		if err != nil {
+			t.Errorf("unexpected error, %v", err)
+			return
+		}
+
+		ok, err := limiter.Take(context.Background())
+		assert.Nil(t, err, c.duration)
+		assert.True(t, ok, c.duration)
+	}
+}
+
+func TestClose(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	// fetched by PreFetch
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 3, 5, 1).
+		SetVal([]interface{}{int64(3), int64(2), int64(0), int64(1000000), int64(5)})
+	// the 2 local tokens are put back into the bucket
+	mock.ExpectEvalSha(ratelimit.ScriptSHA1(ratelimit.TokenBucketRefundAlg), []string{key}, 3, 5, 2).
+		SetVal(int64(2))
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		5,
+		3, WithAntiDDos(false), WithEnablePreFetch(true), WithPreFetchCount(1))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Nil(t, ratelimit.Close(context.Background(), limiter))
+	_, err = limiter.Take(context.Background())
+	assert.ErrorIs(t, err, ratelimit.ErrClosed)
+}
+
+func TestLocalTokensExpire(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 3, 5, 1).
+		SetVal([]interface{}{int64(3), int64(2), int64(0), int64(1000000), int64(5)})
+	// the 2 expired tokens are put back into the bucket before fetching again
+	mock.ExpectEvalSha(ratelimit.ScriptSHA1(ratelimit.TokenBucketRefundAlg), []string{key}, 3, 5, 2).
+		SetVal(int64(2))
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 3, 5, 1).
+		SetVal([]interface{}{int64(3), int64(1), int64(0), int64(1000000), int64(5)})
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		5,
+		3, WithAntiDDos(false), WithLocalTokenTTL(50*time.Millisecond))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	time.Sleep(60 * time.Millisecond)
+	ok, err = limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+// TestLocalTokensExpiry fetches again while local tokens are left, their expiry isn't extended.
+func TestLocalTokensExpiry(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 3, 5, 1).
+		SetVal([]interface{}{int64(3), int64(2), int64(0), int64(1000000), int64(5)})
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 3, 5, 1).
+		SetVal([]interface{}{int64(3), int64(0), int64(0), int64(1000000), int64(5)})
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		5,
+		3, WithAntiDDos(false), WithLocalTokenTTL(50*time.Millisecond))
+	assert.Nil(t, err)
+	r := limiter.(*TokenBucketLimiter)
+
+	start := time.Now()
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	time.Sleep(30 * time.Millisecond)
+	// 2 tokens are left, 1 more is fetched
+	ok, err = r.TakeN(context.Background(), 3)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), r.N)
+	assert.True(t, r.expired(start.Add(60*time.Millisecond)))
+}
+
+func TestStats(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 3, 3, 5, 1).
+		SetVal([]interface{}{int64(3), int64(2), int64(0), int64(1000000), int64(5)})
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		5,
+		3, WithAntiDDos(false))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		ok, err := limiter.Take(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	stats := limiter.(ratelimit.BatchStater).Stats()
+	assert.Equal(t, int64(3), stats.Takes)
+	assert.Equal(t, int64(2), stats.LocalHits)
+	assert.Equal(t, int64(1), stats.Fetches)
+	assert.Equal(t, 3, stats.LastFetchSize)
+	assert.Equal(t, 3, stats.BatchSize)
+	assert.Equal(t, 3.0, stats.AverageFetchSize())
+}
+
+func TestSetLimit(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key}, 10, 5, 20, 1).
+		SetVal([]interface{}{int64(5), int64(15), int64(0), int64(100000), int64(20)})
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		3,
+		1)
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	r := limiter.(*TokenBucketLimiter)
+
+	assert.Nil(t, limiter.(ratelimit.LimitSetter).SetLimit(time.Second, 10))
+	assert.Nil(t, limiter.(ratelimit.BurstSetter).SetBurst(20))
+	assert.Nil(t, limiter.(ratelimit.BatchSizeSetter).SetBatchSize(5))
+	assert.Equal(t, 100*time.Millisecond, r.WaitInterval())
+	// 2x throughput and burst
+	assert.Equal(t, float64(20), float64(r.antiDDoSLimiter.Limit()))
+	assert.Equal(t, 40, r.antiDDoSLimiter.Burst())
+
+	d, err := r.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 20, d.Limit)
+	assert.Equal(t, int64(4), r.N)
+
+	assert.NotNil(t, r.SetLimit(time.Second, 0))
+	assert.NotNil(t, r.SetBurst(0))
+	assert.NotNil(t, r.SetBatchSize(0))
+}
+
+func TestOverrides(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+
+	mock = mock.CustomMatch(MyMatch)
+	value := []byte(`{"throughput":100,"duration_ms":1000,"burst":200}`)
+	mock.ExpectHSet("ov", key, value).SetVal(1)
+	mock.ExpectHGet("ov", key).SetVal(string(value))
+	mock.ExpectHGetAll("ov").SetVal(map[string]string{key: string(value)})
+	mock.ExpectHGet("ov", "other").RedisNil()
+
+	overrides := ratelimit.NewOverrides(db, "ov")
+	o := ratelimit.Override{Duration: time.Second, Throughput: 100, Burst: 200}
+	assert.Nil(t, overrides.Set(context.Background(), key, o))
+	assert.NotNil(t, overrides.Set(context.Background(), key, ratelimit.Override{Duration: time.Second}))
+
+	got, ok, err := overrides.Get(context.Background(), key)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, o, got)
+
+	all, err := overrides.List(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]ratelimit.Override{key: o}, all)
+
+	_, ok, err = overrides.Get(context.Background(), "other")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// the scripts read the hash as KEYS[2]
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectScriptExists(hashVal).SetVal([]bool{true})
+	mock.ExpectEvalSha(hashVal, []string{key, "ov"}, 3, 1, 3, 1).
+		SetVal([]interface{}{int64(1), int64(199), int64(0), int64(10000), int64(200)})
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), db, key,
+		time.Second,
+		3,
+		3,
+		1, WithOverrides("ov"))
+	if err != nil {
+		t.Errorf("unexpected error, %v", err)
+		return
+	}
+	ok, err = limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestLocal(t *testing.T) {
+	limiter, err := NewLocal(time.Second, 10, 2)
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	// the bucket is full at first
+	d, err := taker.TakeDecision(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	d, err = taker.TakeDecision(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ratelimit.ReasonQuotaExhausted, d.Reason)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(d.RetryAfter), float64(10*time.Millisecond))
+
+	_, err = ratelimit.TakeN(context.Background(), limiter, 3)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.Nil(t, limiter.Wait(ctx))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// the tokens are borrowed from the future
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	assert.InDelta(t, float64(200*time.Millisecond), float64(r.Delay()), float64(20*time.Millisecond))
+	r.Cancel()
+	ok, err := limiter.Take(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	limiter, err = ratelimit.New(context.Background(), nil, ratelimit.Config{
+		Algorithm: "token_bucket",
+		Rate:      "10/s",
+		Burst:     2,
+		Local:     true,
+	})
+	assert.Nil(t, err)
+	assert.IsType(t, &TokenBucketLimiter{}, limiter)
+}
+
+func TestCheckLimit(t *testing.T) {
+	// the error of ratelimit.CheckLimit is returned
+	_, err := NewTokenBucketRateLimiter(context.Background(), nil, key, time.Microsecond, 10, 10, 1)
+	assert.NotNil(t, err)
+}
+
+func TestMaxCapacity(t *testing.T) {
+	_, err := NewTokenBucketRateLimiter(context.Background(), nil, key, time.Second, 10, 0, 1)
+	assert.NotNil(t, err)
+	_, err = NewLocal(time.Second, 10, -1)
+	assert.NotNil(t, err)
+}
+
+// TestFlightKey takes more tokens while a fetch of fewer is in flight, it must not join that fetch.
+func TestFlightKey(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), client, key, time.Second, 10, 10, 1,
+		WithAntiDDos(false))
+	assert.Nil(t, err)
+	r := limiter.(*TokenBucketLimiter)
+
+	block := make(chan struct{})
+	go r.g.Do(r.flightKey(1), func() (interface{}, error) {
+		<-block
+		return int64(0), nil
+	})
+	defer close(block)
+	time.Sleep(10 * time.Millisecond)
+
+	result := make(chan bool)
+	go func() {
+		ok, _ := limiter.(ratelimit.MultiTaker).TakeN(context.Background(), 3)
+		result <- ok
+	}()
+	select {
+	case ok := <-result:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Error("TakeN joined the fetch of 1 token")
+	}
+}
+
+// TestOverridesLimit gives the key a larger limit than the one of the constructor.
+func TestOverridesLimit(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	overrides := ratelimit.NewOverrides(client, ratelimit.DefaultOverridesKey)
+	err := overrides.Set(context.Background(), key, ratelimit.Override{Duration: time.Second, Throughput: 10})
+	assert.Nil(t, err)
+	limiter, err := NewTokenBucketRateLimiter(context.Background(), client, key, time.Second, 2, 2, 1,
+		WithAntiDDos(false), WithOverrides(ratelimit.DefaultOverridesKey))
+	assert.Nil(t, err)
+	taker := limiter.(ratelimit.DecisionTaker)
+
+	d, err := taker.TakeDecision(context.Background(), 5)
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 10, d.Limit)
+	_, err = taker.TakeDecision(context.Background(), 11)
+	assert.Equal(t, ratelimit.ErrExceedsLimit, err)
+
+	r, err := limiter.(ratelimit.Reserver).Reserve(context.Background(), 4)
+	assert.Nil(t, err)
+	assert.True(t, r.OK())
+	r, err = limiter.(ratelimit.Reserver).Reserve(context.Background(), 11)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+}
@@ -2,7 +2,6 @@ package tokenbucket
 
 import (
 	"context"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
@@ -10,6 +9,8 @@ import (
 	slog "github.com/vearne/simplelog"
 	"golang.org/x/sync/singleflight"
 	"golang.org/x/time/rate"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -17,23 +18,43 @@ type TokenBucketLimiter struct {
 	ratelimit.BaseRateLimiter
 
 	throughputPerSec float64
-	batchSize        int
+	batch            *ratelimit.BatchSizer
 	maxCapacity      int
 	N                int64
+	// the local tokens expire localTTL after they are fetched, then they are put back into the bucket
+	localTTL time.Duration
+	expireAt time.Time
 
 	g singleflight.Group
 
+	// the state of redis, updated every time tokens are fetched
+	remaining int64
+	retryAt   time.Time
+	resetAt   time.Time
+	// the capacity of the key in redis, which Overrides may change, 0 until it is known
+	limit int64
+
 	/*
 		If the traffic is too large, the limiter will request Redis frequently.
 		To avoid this situation, the frequency of accessing Redis will be limited.
 	*/
-	AntiDDoS        bool
-	antiDDoSLimiter *rate.Limiter
+	AntiDDoS           bool
+	antiDDoSLimiter    *rate.Limiter
+	antiDDoSMultiplier float64
+	antiDDoSBurst      int
+	// the anti-DDoS limiter is created by the limiter rather than WithAntiDDoSLimiter, SetLimit changes it
+	ownAntiDDoS bool
+
+	degradation *ratelimit.Degradation
 	/*
 		Get the token in advance before actually needing to use it
 	*/
 	EnablePreFetch bool
 	PreFetchCount  int64
+	// closed by Close to stop PreFetch
+	done        chan struct{}
+	stopOnce    sync.Once
+	prefetching sync.WaitGroup
 }
 
 type Option func(*TokenBucketLimiter)
@@ -42,64 +63,120 @@ func NewTokenBucketRateLimiter(ctx context.Context, client redis.Cmdable, key st
 	throughput int, maxCapacity int,
 	batchSize int, opts ...Option) (ratelimit.Limiter, error) {
 
-	_, err := client.Ping(ctx).Result()
+	newLimiter, err := prepare(ctx, client, duration, throughput, maxCapacity, batchSize, opts...)
 	if err != nil {
 		return nil, err
 	}
+	r := newLimiter(key)
 
-	if duration < time.Millisecond {
-		return nil, errors.New("duration is too small")
+	// Get the token before actually needing to use it
+	if r.EnablePreFetch {
+		r.prefetching.Add(1)
+		go func() {
+			defer r.prefetching.Done()
+			r.PreFetch()
+		}()
 	}
+	return r, nil
+}
+
+/*
+NewKeyedTokenBucketRateLimiter creates a limiter which limits every key separately,
+the key in redis is keyPrefix + key, and at most maxKeys limiters are kept in memory.
+PreFetch is not supported.
+*/
+func NewKeyedTokenBucketRateLimiter(ctx context.Context, client redis.Cmdable, keyPrefix string,
+	duration time.Duration, throughput int, maxCapacity int, batchSize int,
+	maxKeys int, opts ...Option) (*ratelimit.KeyedLimiter, error) {
 
-	if throughput <= 0 {
-		return nil, errors.New("throughput must greater than 0")
+	if maxKeys <= 0 {
+		return nil, errors.New("maxKeys must greater than 0")
 	}
 
-	if batchSize <= 0 {
-		return nil, errors.New("batchSize must greater than 0")
+	newLimiter, err := prepare(ctx, client, duration, throughput, maxCapacity, batchSize, opts...)
+	if err != nil {
+		return nil, err
 	}
+	return ratelimit.NewKeyedLimiter(maxKeys, func(key string) ratelimit.Limiter {
+		return newLimiter(keyPrefix + key)
+	})
+}
 
-	script := ratelimit.AlgMap[ratelimit.TokenBucketAlg]
-	scriptSHA1 := fmt.Sprintf("%x", sha1.Sum([]byte(script)))
+// check the arguments and load the script once, then limiters of different keys can be created cheaply
+func prepare(ctx context.Context, client redis.Cmdable, duration time.Duration,
+	throughput int, maxCapacity int,
+	batchSize int, opts ...Option) (func(key string) *TokenBucketLimiter, error) {
 
-	r := TokenBucketLimiter{
-		BaseRateLimiter:  ratelimit.BaseRateLimiter{RedisClient: client, ScriptSHA1: scriptSHA1, Key: key},
-		throughputPerSec: float64(throughput) / float64(duration/time.Second),
-		maxCapacity:      maxCapacity,
-		batchSize:        batchSize,
-		N:                0,
-		AntiDDoS:         true,
-		EnablePreFetch:   false, // default value
-		PreFetchCount:    5,     // default value
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return nil, err
 	}
-	r.Interval = duration / time.Duration(throughput)
-	// Loop through each option
-	for _, opt := range opts {
-		// Call the option giving the instantiated
-		opt(&r)
+
+	if maxCapacity <= 0 {
+		return nil, errors.New("maxCapacity must greater than 0")
 	}
 
-	values, err := r.RedisClient.ScriptExists(ctx, r.ScriptSHA1).Result()
+	if batchSize <= 0 {
+		return nil, errors.New("batchSize must greater than 0")
+	}
+
+	degradation, mode, backend := presetOf(opts)
+	scriptSHA1, err := ratelimit.PrepareBackend(ctx, client, backend, ratelimit.TokenBucketAlg, degradation, mode)
 	if err != nil {
 		return nil, err
 	}
-	if !values[0] {
-		_, err = r.RedisClient.ScriptLoad(ctx, script).Result()
-		if err != nil {
-			return nil, err
+
+	return func(key string) *TokenBucketLimiter {
+		r := TokenBucketLimiter{
+			BaseRateLimiter:  ratelimit.BaseRateLimiter{RedisClient: client, ScriptSHA1: scriptSHA1, Key: key},
+			throughputPerSec: float64(ratelimit.PerSecond(throughput, duration)),
+			maxCapacity:      maxCapacity,
+			batch:            ratelimit.NewBatchSizer(batchSize),
+			N:                0,
+			localTTL:         duration,
+			AntiDDoS:         true,
+			EnablePreFetch:   false, // default value
+			PreFetchCount:    5,     // default value
+			done:             make(chan struct{}),
+		}
+		r.Alg = ratelimit.TokenBucketAlg
+		r.Interval = duration / time.Duration(throughput)
+		// Loop through each option
+		for _, opt := range opts {
+			// Call the option giving the instantiated
+			opt(&r)
 		}
-	}
 
-	// 2x throughput
-	if r.AntiDDoS {
-		r.antiDDoSLimiter = rate.NewLimiter(rate.Limit(r.throughputPerSec*2), maxCapacity*2)
-	}
+		// 2x throughput by default
+		if r.AntiDDoS && r.antiDDoSLimiter == nil {
+			r.antiDDoSLimiter = ratelimit.NewAntiDDoSLimiter(rate.Limit(r.throughputPerSec), maxCapacity,
+				r.antiDDoSMultiplier, r.antiDDoSBurst)
+			r.ownAntiDDoS = true
+		}
 
-	// Get the token before actually needing to use it
-	if r.EnablePreFetch {
-		go r.PreFetch()
+		if degradation != nil {
+			probe := ratelimit.BackendProbe(client, backend, mode, ratelimit.TokenBucketAlg)
+			r.Fallback = ratelimit.NewFallback(*degradation, rate.Limit(r.throughputPerSec),
+				maxCapacity, probe)
+		}
+		return &r
+	}, nil
+}
+
+// the options which are needed before the limiters are created, the keys share the circuit breaker
+func presetOf(opts []Option) (*ratelimit.Degradation, ratelimit.ScriptMode, ratelimit.Backend) {
+	var r TokenBucketLimiter
+	for _, opt := range opts {
+		opt(&r)
 	}
-	return &r, nil
+	if r.degradation == nil {
+		return nil, r.ScriptMode(), r.Backend
+	}
+	d := *r.degradation
+	if d.Breaker == nil {
+		d.Breaker = ratelimit.NewCircuitBreaker(ratelimit.DefaultFailureThreshold, ratelimit.DefaultCooldown)
+	}
+	return &d, r.ScriptMode(), r.Backend
 }
 
 func WithAntiDDos(antiDDoS bool) Option {
@@ -108,6 +185,110 @@ func WithAntiDDos(antiDDoS bool) Option {
 	}
 }
 
+// WithAntiDDoSMultiplier sets how many times the throughput the local anti-DDoS limiter allows, 2 by default.
+func WithAntiDDoSMultiplier(multiplier float64) Option {
+	return func(r *TokenBucketLimiter) {
+		r.antiDDoSMultiplier = multiplier
+	}
+}
+
+// WithAntiDDoSBurst sets how many requests the local anti-DDoS limiter allows at once.
+func WithAntiDDoSBurst(burst int) Option {
+	return func(r *TokenBucketLimiter) {
+		r.antiDDoSBurst = burst
+	}
+}
+
+// WithAntiDDoSLimiter replaces the local anti-DDoS limiter, it is shared by all the keys of a keyed limiter.
+func WithAntiDDoSLimiter(limiter *rate.Limiter) Option {
+	return func(r *TokenBucketLimiter) {
+		r.AntiDDoS = true
+		r.antiDDoSLimiter = limiter
+	}
+}
+
+/*
+WithAdaptiveBatch changes the number of tokens fetched from redis at a time between min and max,
+according to the local consumption rate and the tokens remaining in redis, batchSize is ignored.
+*/
+func WithAdaptiveBatch(min, max int) Option {
+	return func(r *TokenBucketLimiter) {
+		r.batch = ratelimit.NewAdaptiveBatchSizer(min, max)
+	}
+}
+
+// WithDegradation decides what to do when redis is unavailable, the errors are returned by default.
+func WithDegradation(d ratelimit.Degradation) Option {
+	return func(r *TokenBucketLimiter) {
+		r.degradation = &d
+	}
+}
+
+// WithName sets the name of the limiter which is given to the Observer.
+func WithName(name string) Option {
+	return func(r *TokenBucketLimiter) {
+		r.Name = name
+	}
+}
+
+// WithObserver sets the Observer which is notified of the decisions, the requests to redis, the errors and the waits.
+func WithObserver(observer ratelimit.Observer) Option {
+	return func(r *TokenBucketLimiter) {
+		r.Observer = observer
+	}
+}
+
+// WithTracer traces Take, Wait and the scripts with tracer, such as the one of the module ratelimit/otel.
+func WithTracer(tracer ratelimit.Tracer) Option {
+	return func(r *TokenBucketLimiter) {
+		r.Tracer = tracer
+	}
+}
+
+/*
+WithOverrides makes the scripts read the limit of the key from the hash hashKey of ratelimit.Overrides,
+the limit given to the constructor is used if the key has none.
+n is checked against the capacity of the key, which Decision.Limit reports,
+but the local checks, such as the anti-DDoS limiter, still use the limit given to the constructor.
+*/
+func WithOverrides(hashKey string) Option {
+	return func(r *TokenBucketLimiter) {
+		r.OverridesKey = hashKey
+	}
+}
+
+// WithPureEval sends the whole script with EVAL every time, for the redis ACLs which block SCRIPT commands.
+func WithPureEval(pureEval bool) Option {
+	return func(r *TokenBucketLimiter) {
+		r.PureEval = pureEval
+	}
+}
+
+// WithFunctions calls the functions of the library loaded by FUNCTION LOAD REPLACE instead of the scripts,
+// Redis 7 is required.
+func WithFunctions(useFunctions bool) Option {
+	return func(r *TokenBucketLimiter) {
+		r.UseFunctions = useFunctions
+	}
+}
+
+// WithBackend runs the scripts with backend instead of the redis client, which may be nil then.
+func WithBackend(backend ratelimit.Backend) Option {
+	return func(r *TokenBucketLimiter) {
+		r.Backend = backend
+	}
+}
+
+/*
+WithLocalTokenTTL sets how long the tokens fetched in a batch can be used locally, duration by default.
+The expired tokens are put back into the bucket in redis, 0 means the tokens never expire.
+*/
+func WithLocalTokenTTL(ttl time.Duration) Option {
+	return func(r *TokenBucketLimiter) {
+		r.localTTL = ttl
+	}
+}
+
 func WithEnablePreFetch(preFetch bool) Option {
 	return func(r *TokenBucketLimiter) {
 		r.EnablePreFetch = preFetch
@@ -122,22 +303,34 @@ func WithPreFetchCount(preFetchCount int64) Option {
 
 // wait until take a token or timeout
 func (r *TokenBucketLimiter) Wait(ctx context.Context) (err error) {
-	ok, err := r.Take(ctx)
+	return r.WaitN(ctx, 1)
+}
+
+// wait until take n tokens at once or timeout
+func (r *TokenBucketLimiter) WaitN(ctx context.Context, n int) (err error) {
+	start := time.Now()
+	ctx, span := r.StartSpan(ctx, "ratelimit.Wait", ratelimit.AttrN.Int(n))
+	defer func() {
+		r.ObserveWait(n, start, err)
+		ratelimit.EndSpan(span, ratelimit.Decision{Allowed: err == nil}, err)
+	}()
+	ok, err := r.TakeN(ctx, n)
 	slog.Debug("r.Take")
 	if err != nil {
 		return err
 	}
+	r.AddPollEvent(ctx, ok)
 	if ok {
 		return nil
 	}
 
 	deadline, ok := ctx.Deadline()
-	minWaitTime := r.Interval
+	minWaitTime := r.WaitInterval()
 	slog.Debug("minWaitTime:%v", minWaitTime)
 	if ok {
 		if deadline.Before(time.Now().Add(minWaitTime)) {
 			slog.Debug("can't get token before %v", deadline)
-			return fmt.Errorf("can't get token before %v", deadline)
+			return fmt.Errorf("%w %v", ratelimit.ErrDeadline, deadline)
 		}
 	}
 
@@ -149,10 +342,11 @@ func (r *TokenBucketLimiter) Wait(ctx context.Context) (err error) {
 		case <-ctx.Done():
 			return errors.New("context timeout")
 		case <-timer.C:
-			ok, err := r.Take(ctx)
+			ok, err := r.TakeN(ctx, n)
 			if err != nil {
 				return err
 			}
+			r.AddPollEvent(ctx, ok)
 			if ok {
 				return nil
 			}
@@ -160,38 +354,90 @@ func (r *TokenBucketLimiter) Wait(ctx context.Context) (err error) {
 	}
 }
 
-func (r *TokenBucketLimiter) tryTakeFromLocal() bool {
+// flightKey is the key of the fetches of n tokens, a fetch only covers the callers which take as many tokens
+func (r *TokenBucketLimiter) flightKey(n int) string {
+	return r.Key + ":" + strconv.Itoa(n)
+}
+
+func (r *TokenBucketLimiter) tryTakeFromLocal(n int) bool {
 	r.Lock()
 	defer r.Unlock()
-	if r.N > 0 {
-		r.N = r.N - 1
+	if r.expired(time.Now()) {
+		return false
+	}
+	if r.N >= int64(n) {
+		r.N = r.N - int64(n)
 		return true
 	}
 	return false
 }
 
+func (r *TokenBucketLimiter) expired(now time.Time) bool {
+	return r.N > 0 && r.localTTL > 0 && !now.Before(r.expireAt)
+}
+
+// put the expired local tokens back into the bucket, so that they can't be held for long
+func (r *TokenBucketLimiter) refundExpired(ctx context.Context) {
+	r.Lock()
+	if !r.expired(time.Now()) {
+		r.Unlock()
+		return
+	}
+	refund := r.N
+	r.N = 0
+	r.Unlock()
+
+	slog.Debug("refund %v expired tokens", refund)
+	err := r.refund(ctx, refund)
+	if err != nil {
+		slog.Error("refund the expired tokens:%v", err)
+	}
+}
+
+func (r *TokenBucketLimiter) refund(ctx context.Context, n int64) error {
+	throughputPerSec, maxCapacity := r.limits()
+	return r.Fallback.Call(ctx, func() error {
+		return r.RunScript(
+			ctx,
+			ratelimit.TokenBucketRefundAlg,
+			r.OverrideKeys(),
+			throughputPerSec,
+			maxCapacity,
+			n,
+		).Err()
+	})
+}
+
 // true: Actually get token in redis
 // false: not need to get
 func (r *TokenBucketLimiter) tryPreFetch() bool {
 	if r.needFetch() {
+		r.refundExpired(context.Background())
 		// try to get from redis
 		// single flight
-		_, err, _ := r.g.Do(r.Key, func() (interface{}, error) {
-			x, err := r.RedisClient.EvalSha(
-				context.Background(),
-				r.ScriptSHA1,
-				[]string{r.Key},
-				r.throughputPerSec,
-				r.batchSize,
-				r.maxCapacity,
-			).Result()
+		_, err, _ := r.g.Do(r.flightKey(1), func() (interface{}, error) {
+			ctx := context.Background()
+			throughputPerSec, maxCapacity := r.limits()
+			var x interface{}
+			start := time.Now()
+			err := r.Fallback.Call(ctx, func() (err error) {
+				x, err = r.EvalScript(
+					ctx,
+					r.OverrideKeys(),
+					throughputPerSec,
+					r.batch.Size(),
+					maxCapacity,
+					1,
+				).Result()
+				return err
+			})
 			if err != nil {
+				r.ObserveFetch(0, start, true, err)
 				return 0, err
 			}
-			r.Lock()
-			r.N += x.(int64)
-			r.Unlock()
-			return r.N, nil
+			values := x.([]interface{})
+			r.ObserveFetch(int(values[0].(int64)), start, true, nil)
+			return r.update(values), nil
 		})
 		if err != nil {
 			slog.Error("get token from redis:%v", err)
@@ -202,55 +448,336 @@ func (r *TokenBucketLimiter) tryPreFetch() bool {
 }
 
 func (r *TokenBucketLimiter) needFetch() bool {
+	if r.Closed() {
+		return false
+	}
 	r.Lock()
 	defer r.Unlock()
-	return r.N < r.PreFetchCount
+	return r.N < r.PreFetchCount || r.expired(time.Now())
 }
 
+// PreFetch keeps fetching tokens in advance until the limiter is closed.
 func (r *TokenBucketLimiter) PreFetch() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
 	for {
 		executeFlag := r.tryPreFetch()
 		slog.Debug("tryPreFetch, %v", executeFlag)
-		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
+// the settings which can be changed by SetLimit and SetBurst
+func (r *TokenBucketLimiter) limits() (float64, int) {
+	r.Lock()
+	defer r.Unlock()
+	return r.throughputPerSec, r.maxCapacity
+}
+
+/*
+SetLimit changes the rate to throughput tokens per duration while the limiter is used,
+the anti-DDoS limiter and the in-process fallback follow it.
+*/
+func (r *TokenBucketLimiter) SetLimit(duration time.Duration, throughput int) error {
+	err := ratelimit.CheckLimit(duration, throughput)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.throughputPerSec = float64(ratelimit.PerSecond(throughput, duration))
+	r.Interval = duration / time.Duration(throughput)
+	r.resetLimits()
+	return nil
+}
+
+// SetBurst changes the capacity of the bucket while the limiter is used.
+func (r *TokenBucketLimiter) SetBurst(maxCapacity int) error {
+	if maxCapacity <= 0 {
+		return errors.New("maxCapacity must greater than 0")
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.maxCapacity = maxCapacity
+	r.resetLimits()
+	return nil
+}
+
+// apply the rate and the capacity to the anti-DDoS limiter and the in-process fallback,
+// the capacity seen in redis is unknown until the next fetch, r must be locked
+func (r *TokenBucketLimiter) resetLimits() {
+	if r.ownAntiDDoS {
+		ratelimit.ResetAntiDDoSLimiter(r.antiDDoSLimiter, rate.Limit(r.throughputPerSec), r.maxCapacity,
+			r.antiDDoSMultiplier, r.antiDDoSBurst)
+	}
+	r.Fallback.SetLimit(rate.Limit(r.throughputPerSec), r.maxCapacity)
+	r.limit = 0
+}
+
+// SetBatchSize changes the number of tokens fetched at a time, an adaptive batch size stops adapting.
+func (r *TokenBucketLimiter) SetBatchSize(batchSize int) error {
+	if batchSize <= 0 {
+		return errors.New("batchSize must greater than 0")
+	}
+	r.batch.SetSize(batchSize)
+	return nil
+}
+
+// Stats shows the fetch sizes and how many takes are served by the local tokens.
+func (r *TokenBucketLimiter) Stats() ratelimit.BatchStats {
+	return r.batch.Stats()
+}
+
+/*
+Close stops PreFetch and puts the local tokens back into the bucket in redis,
+Take returns ratelimit.ErrClosed after it. It is safe to call Close more than once.
+*/
+func (r *TokenBucketLimiter) Close(ctx context.Context) error {
+	_ = r.BaseRateLimiter.Close(ctx)
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
+	// the tokens being fetched are put back as well
+	r.prefetching.Wait()
+	return r.Flush(ctx)
+}
+
+// Flush puts the local tokens back into the bucket in redis, the limiter can still be used after it.
+func (r *TokenBucketLimiter) Flush(ctx context.Context) error {
+	r.Lock()
+	refund := r.N
+	r.N = 0
+	r.Unlock()
+	if refund <= 0 {
+		return nil
+	}
+	return r.refund(ctx, refund)
+}
+
 func (r *TokenBucketLimiter) Take(ctx context.Context) (bool, error) {
+	return r.TakeN(ctx, 1)
+}
+
+/*
+TakeN takes n tokens at once, either all of them or none.
+If n is greater than batchSize, the missing part is fetched from redis in one request.
+n can't be greater than maxCapacity, otherwise ratelimit.ErrExceedsLimit is returned.
+*/
+func (r *TokenBucketLimiter) TakeN(ctx context.Context, n int) (bool, error) {
+	d, err := r.TakeDecision(ctx, n)
+	return d.Allowed, err
+}
+
+// TakeDecision works like TakeN, the remaining tokens include the local ones.
+func (r *TokenBucketLimiter) TakeDecision(ctx context.Context, n int) (d ratelimit.Decision, err error) {
+	ctx, span := r.StartSpan(ctx, "ratelimit.Take", ratelimit.AttrN.Int(n))
+	local := false
+	defer func() {
+		r.ObserveDecision(n, d, local, err)
+		ratelimit.EndSpan(span, d, err)
+	}()
+	if r.Closed() {
+		return ratelimit.Decision{}, ratelimit.ErrClosed
+	}
+	if n <= 0 {
+		return ratelimit.Decision{}, ratelimit.ErrInvalidN
+	}
+	throughputPerSec, maxCapacity := r.limits()
+	// the capacity of the key may be overridden, then only the script knows it
+	if n > maxCapacity && r.OverridesKey == "" {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+
 	// 0. Anti DDoS
 	if r.AntiDDoS {
 		if !r.antiDDoSLimiter.Allow() {
-			return false, nil
+			d = r.decision(false)
+			d.Reason = ratelimit.ReasonLocalShield
+			return d, nil
 		}
 	}
 
 	// 1. try to get from local
-	if r.tryTakeFromLocal() {
-		return true, nil
+	if r.tryTakeFromLocal(n) {
+		local = true
+		r.batch.Took(n, true)
+		return r.decision(true), nil
 	}
 
 	// 2. try to get from redis
+	r.refundExpired(ctx)
 	// single flight
-	_, err, _ := r.g.Do(r.Key, func() (interface{}, error) {
-		x, err := r.RedisClient.EvalSha(
-			ctx,
-			r.ScriptSHA1,
-			[]string{r.Key},
-			r.throughputPerSec,
-			r.batchSize,
-			r.maxCapacity,
-		).Result()
+	_, err, _ = r.g.Do(r.flightKey(n), func() (interface{}, error) {
+		r.Lock()
+		have := r.N
+		r.Unlock()
+		required := int64(n) - have
+		if required <= 0 {
+			return have, nil
+		}
+		var x interface{}
+		start := time.Now()
+		err := r.Fallback.Call(ctx, func() (err error) {
+			x, err = r.EvalScript(
+				ctx,
+				r.OverrideKeys(),
+				throughputPerSec,
+				r.batch.Size(),
+				maxCapacity,
+				required,
+			).Result()
+			return err
+		})
 		if err != nil {
+			r.ObserveFetch(0, start, false, err)
 			return 0, err
 		}
-		r.Lock()
-		r.N += x.(int64)
-		r.Unlock()
-		return r.N, nil
+		values := x.([]interface{})
+		r.ObserveFetch(int(values[0].(int64)), start, false, nil)
+		return r.update(values), nil
 	})
 
 	if err != nil {
-		return false, err
+		return r.Fallback.Decide(n, maxCapacity, err)
 	}
 
-	return r.tryTakeFromLocal(), nil
+	allowed := r.tryTakeFromLocal(n)
+	if allowed {
+		r.batch.Took(n, false)
+	} else if r.exceeds(n) {
+		return ratelimit.Decision{}, ratelimit.ErrExceedsLimit
+	}
+	return r.decision(allowed), nil
+}
+
+// update the state with the result of TokenBucketScript
+func (r *TokenBucketLimiter) update(values []interface{}) int64 {
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	// the tokens left from the earlier fetches keep their expiry, the new ones share it
+	if values[0].(int64) > 0 && r.N <= 0 {
+		r.expireAt = now.Add(r.localTTL)
+	}
+	r.N += values[0].(int64)
+	r.remaining = values[1].(int64)
+	r.limit = values[4].(int64)
+	if r.remaining < 0 {
+		// the tokens are reserved
+		r.remaining = 0
+	}
+	r.batch.Fetched(values[0].(int64), r.remaining)
+	r.retryAt = now.Add(time.Duration(values[2].(int64)) * time.Microsecond)
+	r.resetAt = now.Add(time.Duration(values[3].(int64)) * time.Microsecond)
+	return r.N
+}
+
+// exceeds tells whether n is greater than the capacity of the key which the last fetch saw
+func (r *TokenBucketLimiter) exceeds(n int) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.limit > 0 && int64(n) > r.limit
+}
+
+func (r *TokenBucketLimiter) decision(allowed bool) ratelimit.Decision {
+	r.Lock()
+	defer r.Unlock()
+	d := ratelimit.Decision{
+		Allowed:   allowed,
+		Remaining: int(r.N + r.remaining),
+		Limit:     r.maxCapacity,
+		ResetAt:   r.resetAt,
+	}
+	if r.limit > 0 {
+		d.Limit = int(r.limit)
+	}
+	if !allowed {
+		d.Reason = ratelimit.ReasonQuotaExhausted
+		d.RetryAfter = time.Until(r.retryAt)
+		if d.RetryAfter < r.Interval {
+			d.RetryAfter = r.Interval
+		}
+	}
+	return d
+}
+
+/*
+Reserve reserves n tokens, the tokens in redis may be borrowed from the future,
+redis computes how long it takes until they are refilled.
+The reservation is not OK if n is greater than the capacity,
+which is maxCapacity unless WithOverrides gives the key another one.
+Cancel gives back the tokens like rate.Reservation.CancelAt, except the ones borrowed by the later reservations.
+*/
+func (r *TokenBucketLimiter) Reserve(ctx context.Context, n int) (*ratelimit.Reservation, error) {
+	if r.Closed() {
+		return nil, ratelimit.ErrClosed
+	}
+	if n <= 0 {
+		return nil, ratelimit.ErrInvalidN
+	}
+	throughputPerSec, maxCapacity := r.limits()
+	if n > maxCapacity && r.OverridesKey == "" {
+		return ratelimit.NewReservation(false, 0, nil), nil
+	}
+
+	// 0. Anti DDoS
+	if r.AntiDDoS {
+		if !r.antiDDoSLimiter.Allow() {
+			return ratelimit.NewReservation(false, 0, nil), nil
+		}
+	}
+
+	// 1. try to get from local
+	if r.tryTakeFromLocal(n) {
+		return ratelimit.NewReservation(true, 0, nil), nil
+	}
+
+	// 2. try to reserve in redis
+	r.refundExpired(ctx)
+	var x interface{}
+	err := r.Fallback.Call(ctx, func() (err error) {
+		x, err = r.RunScript(
+			ctx,
+			ratelimit.TokenBucketReserveAlg,
+			r.OverrideKeys(),
+			throughputPerSec,
+			maxCapacity,
+			n,
+		).Result()
+		return err
+	})
+	if err != nil {
+		return r.Fallback.Reserve(n, err)
+	}
+
+	values := x.([]interface{})
+	delay, timeToAct := values[0].(int64), values[1].(int64)
+	if delay < 0 {
+		return ratelimit.NewReservation(false, 0, nil), nil
+	}
+	return ratelimit.NewReservation(true, time.Duration(delay)*time.Microsecond,
+		func(ctx context.Context) error {
+			return r.cancel(ctx, n, timeToAct)
+		}), nil
+}
+
+// cancel gives back the tokens of a reservation like rate.Reservation.CancelAt,
+// except the ones which the later reservations have borrowed, timeToAct is in microseconds of redis.
+func (r *TokenBucketLimiter) cancel(ctx context.Context, n int, timeToAct int64) error {
+	throughputPerSec, maxCapacity := r.limits()
+	return r.Fallback.Call(ctx, func() error {
+		return r.RunScript(
+			ctx,
+			ratelimit.TokenBucketCancelAlg,
+			r.OverrideKeys(),
+			throughputPerSec,
+			maxCapacity,
+			n,
+			timeToAct,
+		).Err()
+	})
 }
@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"context"
+)
+
+/*
+Tracer starts the spans of the limiters, WithTracer of every package sets it.
+The module github.com/vearne/ratelimit/otel adapts an OpenTelemetry TracerProvider to it,
+so the core package doesn't depend on OpenTelemetry.
+*/
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, and returns ctx with the span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is the part of a span which the limiters use.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	AddEvent(name string, attrs ...Attribute)
+	// RecordError records err and marks the span failed.
+	RecordError(err error)
+	End()
+}
+
+// Attribute is an attribute of a span, Value is a string, an int or a bool.
+type Attribute struct {
+	Key   AttributeKey
+	Value interface{}
+}
+
+type AttributeKey string
+
+func (k AttributeKey) String(v string) Attribute {
+	return Attribute{Key: k, Value: v}
+}
+
+func (k AttributeKey) Int(v int) Attribute {
+	return Attribute{Key: k, Value: v}
+}
+
+func (k AttributeKey) Bool(v bool) Attribute {
+	return Attribute{Key: k, Value: v}
+}
+
+// the attributes of the spans
+const (
+	AttrName       = AttributeKey("ratelimit.name")
+	AttrAlgorithm  = AttributeKey("ratelimit.algorithm")
+	AttrKey        = AttributeKey("ratelimit.key")
+	AttrN          = AttributeKey("ratelimit.n")
+	AttrOutcome    = AttributeKey("ratelimit.outcome")
+	AttrAllowed    = AttributeKey("ratelimit.allowed")
+	AttrScript     = AttributeKey("ratelimit.script")
+	AttrScriptMode = AttributeKey("ratelimit.script_mode")
+)
+
+// the values of AttrOutcome besides the names of the reasons
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeError   = "error"
+)
+
+// String returns the name of the mode, such as "evalsha".
+func (m ScriptMode) String() string {
+	switch m {
+	case EvalShaMode:
+		return "evalsha"
+	case EvalMode:
+		return "eval"
+	case FunctionMode:
+		return "function"
+	default:
+		return "unknown"
+	}
+}
+
+// the key of the span of StartSpan in the context, for AddPollEvent
+type spanKey struct{}
+
+// noopSpan is the span of the limiters without a Tracer
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attribute) {}
+
+func (noopSpan) AddEvent(name string, attrs ...Attribute) {}
+
+func (noopSpan) RecordError(err error) {}
+
+func (noopSpan) End() {}
+
+/*
+StartSpan starts a span of r as a child of the span in ctx, it has the name, the algorithm and the key of r.
+If r.Tracer is nil, nothing is recorded and ctx is returned as it is.
+*/
+func (r *BaseRateLimiter) StartSpan(ctx context.Context, name string,
+	attrs ...Attribute) (context.Context, Span) {
+	if r.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	attrs = append(attrs, AttrAlgorithm.String(AlgName(r.Alg)), AttrKey.String(r.Key))
+	if r.Name != "" {
+		attrs = append(attrs, AttrName.String(r.Name))
+	}
+	ctx, span := r.Tracer.Start(ctx, name, attrs...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+/*
+EndSpan ends a span started by StartSpan with the outcome of d,
+which is OutcomeAllowed, OutcomeError or the name of the reason of the rejection.
+*/
+func EndSpan(span Span, d Decision, err error) {
+	switch {
+	case err != nil:
+		span.SetAttributes(AttrOutcome.String(OutcomeError))
+		span.RecordError(err)
+	case d.Allowed:
+		span.SetAttributes(AttrOutcome.String(OutcomeAllowed))
+	default:
+		span.SetAttributes(AttrOutcome.String(d.Reason.String()))
+	}
+	span.End()
+}
+
+// AddPollEvent records a poll of Wait in the span of ctx started by StartSpan, if r.Tracer is set.
+func (r *BaseRateLimiter) AddPollEvent(ctx context.Context, allowed bool) {
+	span, ok := ctx.Value(spanKey{}).(Span)
+	if r.Tracer == nil || !ok {
+		return
+	}
+	span.AddEvent("poll", AttrAllowed.Bool(allowed))
+}